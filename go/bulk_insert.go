@@ -0,0 +1,158 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	mysqlMaxPlaceholders = 65535
+
+	defaultBulkInsertMaxRows     = 5000
+	defaultBulkInsertMaxBytes    = 4 << 20
+	defaultBulkInsertConcurrency = 4
+
+	// interpolateParamsで展開された値1つあたりに上乗せする推定バイト数(クォートや区切り、日時の文字列など)
+	bulkInsertValueOverhead = 24
+)
+
+var (
+	bulkInsertMaxRows     int
+	bulkInsertMaxBytes    int
+	bulkInsertConcurrency int
+
+	bulkInsertStats = expvar.NewMap("bulk_insert")
+)
+
+func loadBulkInsertConfig() {
+	bulkInsertMaxRows = getEnvInt("BULK_INSERT_MAX_ROWS", defaultBulkInsertMaxRows)
+	bulkInsertMaxBytes = getEnvInt("BULK_INSERT_MAX_BYTES", defaultBulkInsertMaxBytes)
+	bulkInsertConcurrency = getEnvInt("BULK_INSERT_CONCURRENCY", defaultBulkInsertConcurrency)
+}
+
+// 複数行INSERTの1文分の範囲と結果
+type bulkInsertChunk struct {
+	Start int // rowsの[Start, End)を書き込む
+	End   int
+	Bytes int // 推定バイト数
+	Err   error
+}
+
+// 複数行INSERTの文
+// Headは "INSERT INTO t (a, b) VALUES" まで、Tailは "ON DUPLICATE KEY UPDATE ..." など後ろに付けるもの
+type bulkInsertStatement struct {
+	Head    string
+	Tail    string
+	Columns int
+}
+
+// 1行分の値の推定バイト数
+func estimateBulkInsertRowBytes(args []interface{}) int {
+	size := 0
+	for _, arg := range args {
+		size += bulkInsertValueOverhead
+		switch v := arg.(type) {
+		case string:
+			// エスケープで最悪倍になる
+			size += len(v) * 2
+		case []byte:
+			size += len(v) * 2
+		}
+	}
+	return size
+}
+
+// 行数とプレースホルダ数、推定バイト数の上限に収まるように分割する
+func splitBulkInsertChunks(stmt bulkInsertStatement, rows [][]interface{}) []bulkInsertChunk {
+	maxRows := mysqlMaxPlaceholders / stmt.Columns
+	if bulkInsertMaxRows > 0 && bulkInsertMaxRows < maxRows {
+		maxRows = bulkInsertMaxRows
+	}
+	baseBytes := len(stmt.Head) + len(stmt.Tail)
+
+	chunks := []bulkInsertChunk{}
+	chunk := bulkInsertChunk{Bytes: baseBytes}
+	for i, row := range rows {
+		rowBytes := estimateBulkInsertRowBytes(row)
+		full := chunk.End-chunk.Start >= maxRows ||
+			(bulkInsertMaxBytes > 0 && chunk.Bytes+rowBytes > bulkInsertMaxBytes)
+		if chunk.End > chunk.Start && full {
+			chunks = append(chunks, chunk)
+			chunk = bulkInsertChunk{Start: i, End: i, Bytes: baseBytes}
+		}
+		chunk.End = i + 1
+		chunk.Bytes += rowBytes
+	}
+	if chunk.End > chunk.Start {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+func execBulkInsertChunk(db *sqlx.DB, stmt bulkInsertStatement, rows [][]interface{}) error {
+	tuple := "(" + strings.TrimSuffix(strings.Repeat("?, ", stmt.Columns), ", ") + ")"
+	args := make([]interface{}, 0, len(rows)*stmt.Columns)
+	placeHolders := &strings.Builder{}
+	for i, row := range rows {
+		args = append(args, row...)
+		if i == 0 {
+			placeHolders.WriteString(" " + tuple)
+		} else {
+			placeHolders.WriteString("," + tuple)
+		}
+	}
+	query := stmt.Head + placeHolders.String()
+	if stmt.Tail != "" {
+		query += " " + stmt.Tail
+	}
+	_, err := db.Exec(query, args...)
+	return err
+}
+
+// 分割したINSERTを最大bulkInsertConcurrency並列で書き込み、チャンク毎の結果を返す
+func execBulkInsert(db *sqlx.DB, stmt bulkInsertStatement, rows [][]interface{}) []bulkInsertChunk {
+	chunks := splitBulkInsertChunks(stmt, rows)
+
+	concurrency := bulkInsertConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := range chunks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(chunk *bulkInsertChunk) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			chunk.Err = execBulkInsertChunk(db, stmt, rows[chunk.Start:chunk.End])
+		}(&chunks[i])
+	}
+	wg.Wait()
+
+	for _, chunk := range chunks {
+		if chunk.Err != nil {
+			bulkInsertStats.Add("chunks_failed", 1)
+			bulkInsertStats.Add("rows_failed", int64(chunk.End-chunk.Start))
+			log.Printf("bulk insert chunk failed: rows=[%d, %d) bytes=%d err=%v", chunk.Start, chunk.End, chunk.Bytes, chunk.Err)
+		} else {
+			bulkInsertStats.Add("chunks_ok", 1)
+			bulkInsertStats.Add("rows_ok", int64(chunk.End-chunk.Start))
+		}
+	}
+	return chunks
+}
+
+// チャンクのうち最初のエラー
+func firstBulkInsertError(chunks []bulkInsertChunk) error {
+	for _, chunk := range chunks {
+		if chunk.Err != nil {
+			return chunk.Err
+		}
+	}
+	return nil
+}
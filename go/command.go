@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// サーバーを起動せずに実行する保守用のコマンド
+// ./isucondition <command>
+var commands = map[string]func() error{
+	"repair-latest-condition":   rebuildLatestIsuConditions,
+	"backfill-condition-hourly": backfillIsuConditionHourly,
+	"replay-dead-letter-file":   replayConditionDeadLetterFile,
+}
+
+func runCommand(args []string) int {
+	log.SetFlags(log.Lshortfile)
+	log.SetOutput(os.Stderr)
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", args[0])
+		fmt.Fprintln(os.Stderr, "commands:")
+		for name := range commands {
+			fmt.Fprintf(os.Stderr, "  %s\n", name)
+		}
+		return 2
+	}
+
+	var err error
+	db, db2, err = NewMySQLConnectionEnv().ConnectDB()
+	if err != nil {
+		log.Printf("failed to connect db: %v", err)
+		return 1
+	}
+	defer db.Close()
+	defer db2.Close()
+	loadBulkInsertConfig()
+
+	if err := cmd(); err != nil {
+		log.Printf("%s: %v", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// CONDITION_DEAD_LETTER_FILEに溜まったものをisu_condition_dead_letterに移す
+func replayConditionDeadLetterFile() error {
+	conditionDeadLetter.File = getEnv("CONDITION_DEAD_LETTER_FILE", defaultConditionDeadLetterFile)
+	return conditionDeadLetter.ReplayFile()
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConditionShards          = 4
+	defaultConditionFlushIntervalMS = 100
+	defaultConditionFlushMaxBatch   = 1000
+)
+
+var errConditionBufferFull = errors.New("condition buffer is full")
+
+// バッファ上でコンディション1件が占めるおおよそのバイト数
+func estimateIsuConditionSize(v *IsuCondition) int {
+	const overhead = 96
+	return overhead + len(v.JIAIsuUUID) + len(v.Condition) + len(v.Message) + len(v.Level)
+}
+
+// jia_isu_uuidのハッシュで振り分けたバッファの1つ
+// 同じISUのコンディションは必ず同じシャードに入り、シャード毎のworkerが順番に書き込む
+type conditionShard struct {
+	M     sync.Mutex
+	V     []*IsuCondition
+	Keys  map[isuConditionKey]int // Vのindex
+	Bytes int
+	// 取り出してDBに書き込んでいる最中のもの。書き込みが終わるまで読み出しから見えるように持っておく
+	Inflight []*IsuCondition
+
+	Index         int
+	Journal       *conditionJournalT
+	FlushInterval time.Duration
+	MaxBatch      int // この件数溜まったらFlushIntervalを待たずに書き込む。INSERTの分割はexecBulkInsertがする
+
+	kick chan struct{}
+}
+
+// シャードに分けたコンディションのバッファ
+// 件数とバイト数の上限は全シャード合計で見る。書き込み中のものも書き込めるまでは数える
+type omIsuConditionListT struct {
+	Shards []*conditionShard
+
+	M          sync.Mutex // Entries, Bytes
+	Entries    int
+	Bytes      int
+	MaxEntries int // 0なら無制限
+	MaxBytes   int // 0なら無制限
+}
+
+var omIsuConditionList omIsuConditionListT
+
+func (o *omIsuConditionListT) Init(shards int, journalDir string, journalSync bool, flushInterval time.Duration, maxBatch int) error {
+	if shards < 1 {
+		shards = 1
+	}
+	o.Shards = make([]*conditionShard, 0, shards)
+	for i := 0; i < shards; i++ {
+		journal := &conditionJournalT{}
+		if err := journal.Open(filepath.Join(journalDir, fmt.Sprintf("shard-%02d", i)), journalSync); err != nil {
+			return err
+		}
+		o.Shards = append(o.Shards, &conditionShard{
+			V:             []*IsuCondition{},
+			Keys:          map[isuConditionKey]int{},
+			Index:         i,
+			Journal:       journal,
+			FlushInterval: flushInterval,
+			MaxBatch:      maxBatch,
+			kick:          make(chan struct{}, 1),
+		})
+	}
+	return nil
+}
+
+func (o *omIsuConditionListT) Close() {
+	for _, shard := range o.Shards {
+		if err := shard.Journal.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (o *omIsuConditionListT) shardOf(jiaIsuUUID string) *conditionShard {
+	h := fnv.New32a()
+	h.Write([]byte(jiaIsuUUID))
+	return o.Shards[int(h.Sum32()%uint32(len(o.Shards)))]
+}
+
+// シャード毎に分け、シャードのindex順に並べる
+func (o *omIsuConditionListT) group(v []*IsuCondition) ([]*conditionShard, [][]int) {
+	indexes := map[*conditionShard][]int{}
+	shards := []*conditionShard{}
+	for i, cond := range v {
+		shard := o.shardOf(cond.JIAIsuUUID)
+		if _, ok := indexes[shard]; !ok {
+			shards = append(shards, shard)
+		}
+		indexes[shard] = append(indexes[shard], i)
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i].Index < shards[j].Index })
+	res := make([][]int, 0, len(shards))
+	for _, shard := range shards {
+		res = append(res, indexes[shard])
+	}
+	return shards, res
+}
+
+// ジャーナルに書けたものだけをバッファに積み、既にバッファかvの前の方に同じ(jia_isu_uuid, timestamp)があったかを返す
+// 上限を超える場合は何も積まずに errConditionBufferFull を返す
+func (o *omIsuConditionListT) Set(v []*IsuCondition) ([]bool, error) {
+	return o.set(v, true)
+}
+
+// 上限を無視して積む。ジャーナルの再投入など既に受け付け済みのものに使う
+// flushで書き込めなかったものは書き込み中も数えているので、戻しても上限を超えない
+func (o *omIsuConditionListT) Restore(v []*IsuCondition) error {
+	_, err := o.set(v, false)
+	return err
+}
+
+func (o *omIsuConditionListT) set(v []*IsuCondition, bounded bool) ([]bool, error) {
+	shards, indexes := o.group(v)
+	// デッドロックしないようにindex順にロックする
+	for _, shard := range shards {
+		shard.M.Lock()
+		defer shard.M.Unlock()
+	}
+
+	duplicated := make([]bool, len(v))
+	pushLists := make([][]*IsuCondition, len(shards))
+	reservedEntries := make([]int, len(shards))
+	reservedBytes := make([]int, len(shards))
+	newEntries, size := 0, 0
+	for i, shard := range shards {
+		items := make([]*IsuCondition, 0, len(indexes[i]))
+		for _, index := range indexes[i] {
+			items = append(items, v[index])
+		}
+		pushList, dup, n := shard.dedup(items)
+		for j, index := range indexes[i] {
+			duplicated[index] = dup[j]
+		}
+		pushLists[i] = pushList
+		reservedEntries[i] = n
+		for _, cond := range pushList {
+			reservedBytes[i] += estimateIsuConditionSize(cond)
+		}
+		newEntries += reservedEntries[i]
+		size += reservedBytes[i]
+	}
+
+	// 他のシャードへのSetと同時に上限を超えないように、確かめると同時に確保しておく
+	o.M.Lock()
+	if bounded && o.MaxEntries > 0 && o.Entries+newEntries > o.MaxEntries {
+		o.M.Unlock()
+		return nil, errConditionBufferFull
+	}
+	if bounded && o.MaxBytes > 0 && o.Bytes+size > o.MaxBytes {
+		o.M.Unlock()
+		return nil, errConditionBufferFull
+	}
+	o.Entries += newEntries
+	o.Bytes += size
+	o.M.Unlock()
+
+	for i, shard := range shards {
+		entries, bytes, err := shard.push(pushLists[i])
+		if err != nil {
+			// 積めなかったシャードから後の確保を戻す
+			o.M.Lock()
+			for j := i; j < len(shards); j++ {
+				o.Entries -= reservedEntries[j]
+				o.Bytes -= reservedBytes[j]
+			}
+			o.M.Unlock()
+			return nil, err
+		}
+		// 上書きした分は確保より少なくなる
+		o.M.Lock()
+		o.Entries += entries - reservedEntries[i]
+		o.Bytes += bytes - reservedBytes[i]
+		o.M.Unlock()
+	}
+	return duplicated, nil
+}
+
+// バッファに積まれているか書き込み中の、jiaIsuUUIDのコンディションのうちfilterを満たすもの
+// 同じtimestampのものは後から積まれた方を返す
+func (o *omIsuConditionListT) Pending(jiaIsuUUID string, filter func(*IsuCondition) bool) []*IsuCondition {
+	if len(o.Shards) == 0 {
+		return nil
+	}
+	shard := o.shardOf(jiaIsuUUID)
+	shard.M.Lock()
+	defer shard.M.Unlock()
+
+	index := map[int64]int{}
+	res := []*IsuCondition{}
+	for _, list := range [][]*IsuCondition{shard.Inflight, shard.V} {
+		for _, cond := range list {
+			if cond.JIAIsuUUID != jiaIsuUUID || !filter(cond) {
+				continue
+			}
+			ts := cond.Timestamp.Unix()
+			if i, ok := index[ts]; ok {
+				res[i] = cond
+				continue
+			}
+			index[ts] = len(res)
+			res = append(res, cond)
+		}
+	}
+	return res
+}
+
+// バッファに溜まっている件数とバイト数。書き込み中のものも含む
+func (o *omIsuConditionListT) Depth() (int, int) {
+	o.M.Lock()
+	defer o.M.Unlock()
+	return o.Entries, o.Bytes
+}
+
+// 重複ポリシーに従って積むものを選ぶ
+func (s *conditionShard) dedup(v []*IsuCondition) ([]*IsuCondition, []bool, int) {
+	pushList := make([]*IsuCondition, 0, len(v))
+	duplicated := make([]bool, len(v))
+	newEntries := 0
+	seen := make(map[isuConditionKey]struct{}, len(v))
+	for i, cond := range v {
+		key := isuConditionKeyOf(cond)
+		_, inBuffer := s.Keys[key]
+		_, inBatch := seen[key]
+		if inBuffer || inBatch {
+			duplicated[i] = true
+			if conditionDuplicatePolicy == conditionDuplicatePolicyIgnore {
+				continue
+			}
+		} else {
+			newEntries++
+		}
+		seen[key] = struct{}{}
+		pushList = append(pushList, cond)
+	}
+	return pushList, duplicated, newEntries
+}
+
+// 増えた件数とバイト数を返す
+func (s *conditionShard) push(v []*IsuCondition) (int, int, error) {
+	if len(v) == 0 {
+		return 0, 0, nil
+	}
+	if err := s.Journal.Append(v); err != nil {
+		return 0, 0, err
+	}
+	entries, bytes := 0, 0
+	for _, cond := range v {
+		key := isuConditionKeyOf(cond)
+		if i, ok := s.Keys[key]; ok {
+			bytes -= estimateIsuConditionSize(s.V[i])
+			s.V[i] = cond
+		} else {
+			s.Keys[key] = len(s.V)
+			s.V = append(s.V, cond)
+			entries++
+		}
+		bytes += estimateIsuConditionSize(cond)
+	}
+	s.Bytes += bytes
+	if s.MaxBatch > 0 && len(s.V) >= s.MaxBatch {
+		select {
+		case s.kick <- struct{}{}:
+		default:
+		}
+	}
+	return entries, bytes, nil
+}
+
+// バッファを取り出し、取り出した分が書かれているジャーナルのセグメントを返す
+// セグメントを切り替えられなかった場合は""を返す。取り出した分は次に切り替えたセグメントと一緒に消える
+func (s *conditionShard) take() ([]*IsuCondition, int, string) {
+	s.M.Lock()
+	defer s.M.Unlock()
+	v := s.V
+	if len(v) == 0 {
+		return v, 0, ""
+	}
+	bytes := s.Bytes
+	s.Inflight = v
+	s.V = []*IsuCondition{}
+	s.Keys = map[isuConditionKey]int{}
+	s.Bytes = 0
+	segment, err := s.Journal.Rotate()
+	if err != nil {
+		log.Println(err)
+	}
+	return v, bytes, segment
+}
+
+// stopが閉じられたら最後にもう一度flushして終わる
+func (s *conditionShard) loop(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.kick:
+			s.flush()
+		case <-stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+func (s *conditionShard) flush() {
+	isuConditions, bytes, journalSegment := s.take()
+	if len(isuConditions) == 0 {
+		retryIsuConditionHourlyDirty()
+		return
+	}
+	defer func() {
+		s.M.Lock()
+		s.Inflight = nil
+		s.M.Unlock()
+	}()
+
+	// INSERTの分割と並列化はexecBulkInsertのBULK_INSERT_MAX_ROWS/BYTESに任せる
+	startedAt := time.Now()
+	inserted, pending, err := writeIsuConditions(isuConditions)
+	conditionShedder.ObserveFlush(time.Since(startedAt))
+	if err != nil {
+		log.Println(err)
+	}
+
+	// 書き込めなかった分はRestoreで数え直す
+	omIsuConditionList.M.Lock()
+	omIsuConditionList.Entries -= len(isuConditions)
+	omIsuConditionList.Bytes -= bytes
+	omIsuConditionList.M.Unlock()
+
+	if len(pending) > 0 {
+		// 行に依らない失敗なので書き込めなかった分はバッファに戻して次のflushでやり直す
+		if err := omIsuConditionList.Restore(pending); err != nil {
+			// ジャーナルは残しておき、次回起動時に再投入させる
+			log.Println(err)
+			return
+		}
+	}
+	s.Journal.Remove(journalSegment)
+
+	if len(inserted) > 0 {
+		bulkInsertLatestIsuLevels(inserted)
+		if err := refreshIsuConditionHourly(inserted); err != nil {
+			// dirtyにした時間は次のflushでやり直す
+			log.Printf("failed to refresh isu_condition_hourly: %v", err)
+		}
+	}
+	retryIsuConditionHourlyDirty()
+}
+
+// シャード毎のworkerを動かし、stopが閉じられたら全てのworkerが書き切ってからdoneを閉じる
+func loopPostIsuCondition(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	var wg sync.WaitGroup
+	for _, shard := range omIsuConditionList.Shards {
+		wg.Add(1)
+		go func(shard *conditionShard) {
+			defer wg.Done()
+			shard.loop(stop)
+		}(shard)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	mimeApplicationMsgpack  = "application/msgpack"
+	mimeApplicationXMsgpack = "application/x-msgpack"
+	mimeApplicationProtobuf = "application/x-protobuf"
+	mimeApplicationProto    = "application/protobuf"
+)
+
+var errUnsupportedConditionContentType = errors.New("unsupported content type")
+
+// 3つのフラグからコンディションの文字列を組み立てる
+func formatConditionFlags(isDirty, isOverweight, isBroken bool) string {
+	return fmt.Sprintf("is_dirty=%t,is_overweight=%t,is_broken=%t", isDirty, isOverweight, isBroken)
+}
+
+// MessagePackで受け取るコンディション
+// conditionの文字列の代わりにis_dirty, is_overweight, is_brokenの3つのboolでも送れる
+type msgpackIsuCondition struct {
+	IsSitting    bool   `msgpack:"is_sitting"`
+	Condition    string `msgpack:"condition"`
+	IsDirty      *bool  `msgpack:"is_dirty"`
+	IsOverweight *bool  `msgpack:"is_overweight"`
+	IsBroken     *bool  `msgpack:"is_broken"`
+	Message      string `msgpack:"message"`
+	Timestamp    int64  `msgpack:"timestamp"`
+}
+
+func (v msgpackIsuCondition) request() PostIsuConditionRequest {
+	condition := v.Condition
+	if condition == "" && (v.IsDirty != nil || v.IsOverweight != nil || v.IsBroken != nil) {
+		flag := func(b *bool) bool { return b != nil && *b }
+		condition = formatConditionFlags(flag(v.IsDirty), flag(v.IsOverweight), flag(v.IsBroken))
+	}
+	return PostIsuConditionRequest{
+		IsSitting: v.IsSitting,
+		Condition: condition,
+		Message:   v.Message,
+		Timestamp: v.Timestamp,
+	}
+}
+
+func decodeMsgpackIsuConditions(body []byte) ([]PostIsuConditionRequest, error) {
+	conds := []msgpackIsuCondition{}
+	if err := msgpack.Unmarshal(body, &conds); err != nil {
+		return nil, err
+	}
+	req := make([]PostIsuConditionRequest, 0, len(conds))
+	for _, cond := range conds {
+		req = append(req, cond.request())
+	}
+	return req, nil
+}
+
+// proto/isu_condition.proto の PostIsuConditionRequestList をデコードする
+// 生成コードを持ち込まないようにprotowireで直接読む。知らないフィールドは読み飛ばす
+func decodeProtobufIsuConditions(body []byte) ([]PostIsuConditionRequest, error) {
+	req := []PostIsuConditionRequest{}
+	for len(body) > 0 {
+		num, typ, n := protowire.ConsumeTag(body)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		body = body[n:]
+		if num == 1 && typ == protowire.BytesType {
+			msg, n := protowire.ConsumeBytes(body)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			cond, err := decodeProtobufIsuCondition(msg)
+			if err != nil {
+				return nil, err
+			}
+			req = append(req, cond)
+			body = body[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, body)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		body = body[n:]
+	}
+	return req, nil
+}
+
+func decodeProtobufIsuCondition(msg []byte) (PostIsuConditionRequest, error) {
+	var isDirty, isOverweight, isBroken bool
+	req := PostIsuConditionRequest{}
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return req, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+
+		switch {
+		case typ == protowire.VarintType && num >= 1 && num <= 4:
+			v, n := protowire.ConsumeVarint(msg)
+			if n < 0 {
+				return req, protowire.ParseError(n)
+			}
+			switch num {
+			case 1:
+				req.IsSitting = protowire.DecodeBool(v)
+			case 2:
+				isDirty = protowire.DecodeBool(v)
+			case 3:
+				isOverweight = protowire.DecodeBool(v)
+			case 4:
+				isBroken = protowire.DecodeBool(v)
+			}
+			msg = msg[n:]
+		case typ == protowire.BytesType && num == 5:
+			v, n := protowire.ConsumeString(msg)
+			if n < 0 {
+				return req, protowire.ParseError(n)
+			}
+			req.Message = v
+			msg = msg[n:]
+		case typ == protowire.VarintType && num == 6:
+			v, n := protowire.ConsumeVarint(msg)
+			if n < 0 {
+				return req, protowire.ParseError(n)
+			}
+			req.Timestamp = int64(v)
+			msg = msg[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, msg)
+			if n < 0 {
+				return req, protowire.ParseError(n)
+			}
+			msg = msg[n:]
+		}
+	}
+	req.Condition = formatConditionFlags(isDirty, isOverweight, isBroken)
+	return req, nil
+}
+
+// Content-Typeを見てPOST /api/condition/:jia_isu_uuid のボディをデコードする
+// JSONはこれまで通りBindに任せる
+func bindPostIsuConditionRequest(c echo.Context) ([]PostIsuConditionRequest, error) {
+	mediaType, _, err := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if err != nil {
+		mediaType = ""
+	}
+
+	var decode func([]byte) ([]PostIsuConditionRequest, error)
+	switch mediaType {
+	case mimeApplicationMsgpack, mimeApplicationXMsgpack:
+		decode = decodeMsgpackIsuConditions
+	case mimeApplicationProtobuf, mimeApplicationProto:
+		decode = decodeProtobufIsuConditions
+	case "", echo.MIMEApplicationJSON:
+		req := []PostIsuConditionRequest{}
+		if err := c.Bind(&req); err != nil {
+			return nil, err
+		}
+		return req, nil
+	default:
+		return nil, errUnsupportedConditionContentType
+	}
+
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return nil, err
+	}
+	return decode(body)
+}
+
+// デコードに失敗した場合のレスポンス
+func bindConditionErrorResponse(c echo.Context, err error) error {
+	if errors.Is(err, errUnsupportedConditionContentType) {
+		return c.String(http.StatusUnsupportedMediaType, "unsupported content type")
+	}
+	return c.String(http.StatusBadRequest, "bad request body")
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultConditionMaxCompressedBytes   = 8 << 20
+	defaultConditionMaxDecompressedBytes = 64 << 20
+	// zstdのフレームが要求できるウィンドウの上限。これより大きいものは展開せずに弾く
+	conditionZstdMaxWindow = 8 << 20
+)
+
+var (
+	// 送られてきたままのボディの上限。Content-Encodingに依らない
+	conditionMaxCompressedBytes int64 = defaultConditionMaxCompressedBytes
+	// 展開後のボディの上限
+	conditionMaxDecompressedBytes int64 = defaultConditionMaxDecompressedBytes
+
+	errConditionBodyTooLarge          = errors.New("request body too large")
+	errUnsupportedConditionEncoding   = errors.New("unsupported content encoding")
+	errBadConditionCompressedEncoding = errors.New("bad compressed body")
+)
+
+func loadConditionCompressionConfig() {
+	conditionMaxCompressedBytes = int64(getEnvInt("CONDITION_MAX_COMPRESSED_BYTES", defaultConditionMaxCompressedBytes))
+	conditionMaxDecompressedBytes = int64(getEnvInt("CONDITION_MAX_DECOMPRESSED_BYTES", defaultConditionMaxDecompressedBytes))
+}
+
+// 上限+1バイトまで読み、上限を超えていたら errConditionBodyTooLarge を返す
+func readAllLimited(r io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, errConditionBodyTooLarge
+	}
+	return b, nil
+}
+
+// 送られてきたままのボディを上限付きで読み、後で読めるように戻しておく
+// 署名は送られてきたままのボディに対して検証するので、展開より先に呼ぶ
+func readConditionBody(c echo.Context) ([]byte, error) {
+	req := c.Request()
+	if conditionMaxCompressedBytes > 0 && req.ContentLength > conditionMaxCompressedBytes {
+		return nil, errConditionBodyTooLarge
+	}
+	body, err := readAllLimited(req.Body, conditionMaxCompressedBytes)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// Content-Encodingに従ってbodyを展開し、展開したものをリクエストのボディに差し替える
+func decompressConditionBody(c echo.Context, jiaIsuUUID string, body []byte) error {
+	req := c.Request()
+	encoding := strings.ToLower(strings.TrimSpace(req.Header.Get(echo.HeaderContentEncoding)))
+
+	var decoded []byte
+	switch encoding {
+	case "", "identity":
+		conditionCompression.Record(jiaIsuUUID, "identity", len(body), len(body))
+		return nil
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return errBadConditionCompressedEncoding
+		}
+		defer r.Close()
+		decoded, err = readAllLimited(r, conditionMaxDecompressedBytes)
+		if err != nil {
+			if errors.Is(err, errConditionBodyTooLarge) {
+				return err
+			}
+			return errBadConditionCompressedEncoding
+		}
+	case "zstd":
+		// 展開後の大きさはreadAllLimitedで打ち切り、ウィンドウとフレームの大きさはデコーダで制限する
+		opts := []zstd.DOption{zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true), zstd.WithDecoderMaxWindow(conditionZstdMaxWindow)}
+		if conditionMaxDecompressedBytes > 0 {
+			opts = append(opts, zstd.WithDecoderMaxMemory(uint64(conditionMaxDecompressedBytes)))
+		}
+		r, err := zstd.NewReader(bytes.NewReader(body), opts...)
+		if err != nil {
+			return errBadConditionCompressedEncoding
+		}
+		defer r.Close()
+		decoded, err = readAllLimited(r, conditionMaxDecompressedBytes)
+		if err != nil {
+			if errors.Is(err, errConditionBodyTooLarge) || errors.Is(err, zstd.ErrWindowSizeExceeded) || errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+				return errConditionBodyTooLarge
+			}
+			return errBadConditionCompressedEncoding
+		}
+	default:
+		return errUnsupportedConditionEncoding
+	}
+
+	conditionCompression.Record(jiaIsuUUID, encoding, len(body), len(decoded))
+	req.Body = ioutil.NopCloser(bytes.NewReader(decoded))
+	req.ContentLength = int64(len(decoded))
+	req.Header.Del(echo.HeaderContentEncoding)
+	return nil
+}
+
+// 読み込みか展開に失敗した場合のレスポンス
+func conditionBodyErrorResponse(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, errConditionBodyTooLarge):
+		conditionCompressionRejected.Add("too_large", 1)
+		return c.String(http.StatusRequestEntityTooLarge, err.Error())
+	case errors.Is(err, errUnsupportedConditionEncoding):
+		conditionCompressionRejected.Add("unsupported", 1)
+		return c.String(http.StatusUnsupportedMediaType, err.Error())
+	case errors.Is(err, errBadConditionCompressedEncoding):
+		conditionCompressionRejected.Add("bad_body", 1)
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	return c.String(http.StatusBadRequest, "bad request body")
+}
+
+// ISU毎の圧縮の統計
+type conditionCompressionStats struct {
+	Requests          int64            `json:"requests"`
+	Encodings         map[string]int64 `json:"encodings"`
+	CompressedBytes   int64            `json:"compressed_bytes"`
+	DecompressedBytes int64            `json:"decompressed_bytes"`
+	Ratio             float64          `json:"ratio"`      // 展開後 / 圧縮後 の累計
+	LastRatio         float64          `json:"last_ratio"` // 直近のリクエスト
+	MaxRatio          float64          `json:"max_ratio"`
+}
+
+type conditionCompressionStatsT struct {
+	M sync.Mutex
+	V map[string]*conditionCompressionStats
+}
+
+var (
+	conditionCompression         = conditionCompressionStatsT{V: map[string]*conditionCompressionStats{}}
+	conditionCompressionRejected = expvar.NewMap("condition_compression_rejected")
+)
+
+func (s *conditionCompressionStatsT) Record(jiaIsuUUID, encoding string, compressed, decompressed int) {
+	ratio := 1.0
+	if compressed > 0 {
+		ratio = float64(decompressed) / float64(compressed)
+	}
+
+	s.M.Lock()
+	defer s.M.Unlock()
+	stats, ok := s.V[jiaIsuUUID]
+	if !ok {
+		stats = &conditionCompressionStats{Encodings: map[string]int64{}}
+		s.V[jiaIsuUUID] = stats
+	}
+	stats.Requests++
+	stats.Encodings[encoding]++
+	stats.CompressedBytes += int64(compressed)
+	stats.DecompressedBytes += int64(decompressed)
+	if stats.CompressedBytes > 0 {
+		stats.Ratio = float64(stats.DecompressedBytes) / float64(stats.CompressedBytes)
+	}
+	stats.LastRatio = ratio
+	if ratio > stats.MaxRatio {
+		stats.MaxRatio = ratio
+	}
+}
+
+func (s *conditionCompressionStatsT) Snapshot() map[string]conditionCompressionStats {
+	s.M.Lock()
+	defer s.M.Unlock()
+	res := make(map[string]conditionCompressionStats, len(s.V))
+	for k, v := range s.V {
+		stats := *v
+		stats.Encodings = make(map[string]int64, len(v.Encodings))
+		for encoding, n := range v.Encodings {
+			stats.Encodings[encoding] = n
+		}
+		res[k] = stats
+	}
+	return res
+}
+
+func init() {
+	expvar.Publish("condition_compression", expvar.Func(func() interface{} {
+		return conditionCompression.Snapshot()
+	}))
+}
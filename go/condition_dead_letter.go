@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultConditionDeadLetterFile = "../tmp/condition_dead_letter.jsonl"
+	defaultDeadLetterListLimit     = 100
+	defaultDeadLetterRedriveLimit  = 1000
+	deadLetterReplayChunk          = 500
+)
+
+// 何度書き込んでも通らなかったコンディションの置き場所
+// isu_condition_dead_letter テーブルに入れ、それすら失敗した場合はファイルに追記する
+// ファイルに入ったものは起動時かredriveの前にテーブルへ移す
+type conditionDeadLetterT struct {
+	M    sync.Mutex
+	File string
+}
+
+var conditionDeadLetter conditionDeadLetterT
+
+type DeadLetterCondition struct {
+	ID         int64     `db:"id" json:"id"`
+	JIAIsuUUID string    `db:"jia_isu_uuid" json:"jia_isu_uuid"`
+	Timestamp  time.Time `db:"timestamp" json:"-"`
+	IsSitting  bool      `db:"is_sitting" json:"is_sitting"`
+	Condition  string    `db:"condition" json:"condition"`
+	Message    string    `db:"message" json:"message"`
+	Level      string    `db:"level" json:"condition_level"`
+	Error      string    `db:"error" json:"error"`
+	CreatedAt  time.Time `db:"created_at" json:"-"`
+
+	UnixTimestamp int64 `db:"-" json:"timestamp"`
+	UnixCreatedAt int64 `db:"-" json:"created_at"`
+}
+
+type RedriveDeadLetterRequest struct {
+	IDs []int64 `json:"ids"`
+}
+
+type RedriveDeadLetterResponse struct {
+	Redriven int  `json:"redriven"`
+	HasMore  bool `json:"has_more"` // idsを省略した場合に、まだ残っているか
+}
+
+func (d *conditionDeadLetterT) Put(isuConditions []*IsuCondition, cause error) {
+	rows := make([]DeadLetterCondition, 0, len(isuConditions))
+	for _, v := range isuConditions {
+		log.Printf("dead letter condition: jia_isu_uuid=%s timestamp=%d err=%v", v.JIAIsuUUID, v.Timestamp.Unix(), cause)
+		rows = append(rows, DeadLetterCondition{
+			JIAIsuUUID: v.JIAIsuUUID,
+			Timestamp:  v.Timestamp,
+			IsSitting:  v.IsSitting,
+			Condition:  v.Condition,
+			Message:    v.Message,
+			Level:      v.Level,
+			Error:      cause.Error(),
+		})
+	}
+	_, err := db2.NamedExec("INSERT INTO `isu_condition_dead_letter` (`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `level`, `error`)"+
+		" VALUES (:jia_isu_uuid, :timestamp, :is_sitting, :condition, :message, :level, :error)", rows)
+	if err == nil {
+		return
+	}
+	log.Printf("failed to insert dead letter, fallback to file: %v", err)
+
+	d.M.Lock()
+	defer d.M.Unlock()
+	f, err := os.OpenFile(d.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	for _, row := range rows {
+		row.UnixTimestamp = row.Timestamp.Unix()
+		if err := enc.Encode(row); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// ファイルに追記されたものをテーブルに移し、移し終えたらファイルを消す
+// 1つのトランザクションで入れるので、途中で失敗した場合はファイルに全て残る
+func (d *conditionDeadLetterT) ReplayFile() error {
+	d.M.Lock()
+	defer d.M.Unlock()
+	f, err := os.Open(d.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rows := []DeadLetterCondition{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	for scanner.Scan() {
+		row := DeadLetterCondition{}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			log.Printf("skip broken dead letter line: %v", err)
+			continue
+		}
+		row.Timestamp = time.Unix(row.UnixTimestamp, 0)
+		rows = append(rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db2.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for start := 0; start < len(rows); start += deadLetterReplayChunk {
+		end := start + deadLetterReplayChunk
+		if end > len(rows) {
+			end = len(rows)
+		}
+		_, err := tx.NamedExec("INSERT INTO `isu_condition_dead_letter` (`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `level`, `error`)"+
+			" VALUES (:jia_isu_uuid, :timestamp, :is_sitting, :condition, :message, :level, :error)", rows[start:end])
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if len(rows) > 0 {
+		log.Printf("replayed %d dead letter conditions from %s", len(rows), d.File)
+	}
+	return os.Remove(d.File)
+}
+
+// GET /admin/condition/dead_letter
+// dead letterに入っているコンディションを確認
+func getConditionDeadLetter(c echo.Context) error {
+	limit := defaultDeadLetterListLimit
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return c.String(http.StatusBadRequest, "bad format: limit")
+		}
+	}
+
+	rows := []DeadLetterCondition{}
+	var err error
+	if jiaIsuUUID := c.QueryParam("jia_isu_uuid"); jiaIsuUUID != "" {
+		err = db2.Select(&rows, "SELECT * FROM `isu_condition_dead_letter` WHERE `jia_isu_uuid` = ? ORDER BY `id` LIMIT ?", jiaIsuUUID, limit)
+	} else {
+		err = db2.Select(&rows, "SELECT * FROM `isu_condition_dead_letter` ORDER BY `id` LIMIT ?", limit)
+	}
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	for i := range rows {
+		rows[i].UnixTimestamp = rows[i].Timestamp.Unix()
+		rows[i].UnixCreatedAt = rows[i].CreatedAt.Unix()
+	}
+
+	return c.JSON(http.StatusOK, rows)
+}
+
+// POST /admin/condition/dead_letter/redrive
+// dead letterのコンディションをバッファに戻して書き込み直す。idsを省略した場合は古いものからlimit件
+// バッファの上限を超える場合は何もせずに503を返す
+func postConditionDeadLetterRedrive(c echo.Context) error {
+	var req RedriveDeadLetterRequest
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&req); err != nil {
+			return c.String(http.StatusBadRequest, "bad request body")
+		}
+	}
+	limit := defaultDeadLetterRedriveLimit
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return c.String(http.StatusBadRequest, "bad format: limit")
+		}
+	}
+	if len(req.IDs) > limit {
+		return c.String(http.StatusBadRequest, "too many ids: max "+strconv.Itoa(limit))
+	}
+
+	if err := conditionDeadLetter.ReplayFile(); err != nil {
+		c.Logger().Errorf("failed to replay dead letter file: %v", err)
+	}
+
+	rows := []DeadLetterCondition{}
+	hasMore := false
+	if len(req.IDs) == 0 {
+		if err := db2.Select(&rows, "SELECT * FROM `isu_condition_dead_letter` ORDER BY `id` LIMIT ?", limit+1); err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if len(rows) > limit {
+			rows, hasMore = rows[:limit], true
+		}
+	} else {
+		query, params, err := sqlx.In("SELECT * FROM `isu_condition_dead_letter` WHERE `id` IN (?) ORDER BY `id`", req.IDs)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if err := db2.Select(&rows, db2.Rebind(query), params...); err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	if len(rows) == 0 {
+		return c.JSON(http.StatusOK, RedriveDeadLetterResponse{})
+	}
+
+	ids := make([]int64, 0, len(rows))
+	isuConditions := make([]*IsuCondition, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.ID)
+		isuConditions = append(isuConditions, &IsuCondition{
+			JIAIsuUUID: row.JIAIsuUUID,
+			Timestamp:  row.Timestamp,
+			IsSitting:  row.IsSitting,
+			Condition:  row.Condition,
+			Message:    row.Message,
+			Level:      row.Level,
+		})
+	}
+
+	// 先にバッファ(ジャーナル)に積んでから消すので、途中で落ちても失われない
+	if _, err := omIsuConditionList.Set(isuConditions); err != nil {
+		if errors.Is(err, errConditionBufferFull) {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(conditionBufferRetryAfter))
+			return c.String(http.StatusServiceUnavailable, "condition buffer is full")
+		}
+		c.Logger().Errorf("journal error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	query, params, err := sqlx.In("DELETE FROM `isu_condition_dead_letter` WHERE `id` IN (?)", ids)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if _, err := db2.Exec(db2.Rebind(query), params...); err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, RedriveDeadLetterResponse{Redriven: len(rows), HasMore: hasMore})
+}
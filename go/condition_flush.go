@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	defaultConditionFlushRetry     = 3
+	defaultConditionFlushBackoffMS = 50
+	maxConditionFlushBackoff       = time.Second
+
+	defaultConditionFlushMaxFailures = 5
+)
+
+var (
+	conditionFlushRetry   int
+	conditionFlushBackoff time.Duration
+	// 行がこの回数続けてflushに失敗したら、エラーの種類に依らず二分して原因の行をdead letterに送る
+	conditionFlushMaxFailures int
+)
+
+// flushに続けて失敗した回数。書き込めるかdead letterに送ったら消す
+type omConditionFlushFailuresT struct {
+	M sync.Mutex
+	V map[isuConditionKey]int
+}
+
+var omConditionFlushFailures = omConditionFlushFailuresT{V: map[isuConditionKey]int{}}
+
+// 失敗した回数を1増やし、上限に達したものがあるかを返す
+func (o *omConditionFlushFailuresT) Fail(v []*IsuCondition) bool {
+	o.M.Lock()
+	defer o.M.Unlock()
+	exceeded := false
+	for _, cond := range v {
+		key := isuConditionKeyOf(cond)
+		o.V[key]++
+		if conditionFlushMaxFailures > 0 && o.V[key] >= conditionFlushMaxFailures {
+			exceeded = true
+		}
+	}
+	return exceeded
+}
+
+func (o *omConditionFlushFailuresT) Clear(v []*IsuCondition) {
+	o.M.Lock()
+	defer o.M.Unlock()
+	for _, cond := range v {
+		delete(o.V, isuConditionKeyOf(cond))
+	}
+}
+
+// 行の中身が原因で起こるMySQLのエラー番号
+// read onlyへの切り替えやテーブルが一杯など、ここに無いものは全て行に依らない失敗として扱う
+var mysqlDataErrNums = map[uint16]struct{}{
+	1048: {}, // Column cannot be null
+	1062: {}, // Duplicate entry
+	1264: {}, // Out of range value
+	1265: {}, // Data truncated
+	1292: {}, // Incorrect value
+	1366: {}, // Incorrect string value
+	1406: {}, // Data too long
+	3140: {}, // Invalid JSON text
+}
+
+// 行の中身が原因で失敗したかどうか。これらは何度やり直しても通らないので二分して原因の行を探す
+func isConditionDataError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	_, ok := mysqlDataErrNums[mysqlErr.Number]
+	return ok
+}
+
+var isuConditionInsertStatement = bulkInsertStatement{
+	Head:    "INSERT INTO `isu_condition` (`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `level`) VALUES",
+	Columns: 6,
+}
+
+func isuConditionInsertRows(isuConditions []*IsuCondition) [][]interface{} {
+	rows := make([][]interface{}, 0, len(isuConditions))
+	for _, v := range isuConditions {
+		rows = append(rows, []interface{}{v.JIAIsuUUID, v.Timestamp, v.IsSitting, v.Condition, v.Message, v.Level})
+	}
+	return rows
+}
+
+// 1文でINSERTする。リトライや二分探索に使うのでチャンクの上限に収まっている前提
+func insertIsuConditions(isuConditions []*IsuCondition) error {
+	return execBulkInsertChunk(db2, isuConditionInsertStatement, isuConditionInsertRows(isuConditions))
+}
+
+// 指数バックオフを挟みながらINSERTをやり直す
+// 行が原因の失敗はやり直しても通らないので、すぐに返す
+func retryInsertIsuConditions(isuConditions []*IsuCondition, err error) error {
+	backoff := conditionFlushBackoff
+	for attempt := 1; attempt <= conditionFlushRetry; attempt++ {
+		if isConditionDataError(err) {
+			return err
+		}
+		log.Printf("retry condition flush: attempt=%d rows=%d err=%v", attempt, len(isuConditions), err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxConditionFlushBackoff {
+			backoff = maxConditionFlushBackoff
+		}
+		if err = insertIsuConditions(isuConditions); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// コンディションをチャンクに分けてDBに書き込み、書き込めたものを返す
+// 失敗したチャンクはやり直し、行が原因で失敗する場合は二分して原因の行だけをdead letterに送る
+// DBに繋がらないなど行に依らない失敗はerrと一緒に書き込めなかった残りを返すので、呼び出し側でバッファに戻す
+func writeIsuConditions(isuConditions []*IsuCondition) ([]*IsuCondition, []*IsuCondition, error) {
+	chunks := execBulkInsert(db2, isuConditionInsertStatement, isuConditionInsertRows(isuConditions))
+
+	inserted := make([]*IsuCondition, 0, len(isuConditions))
+	pending := []*IsuCondition{}
+	var lastErr error
+	for _, chunk := range chunks {
+		rows := isuConditions[chunk.Start:chunk.End]
+		if chunk.Err == nil {
+			inserted = append(inserted, rows...)
+			continue
+		}
+		if lastErr != nil {
+			// 既にDBに繋がらない状態なのでやり直さずに戻す
+			pending = append(pending, rows...)
+			continue
+		}
+
+		err := retryInsertIsuConditions(rows, chunk.Err)
+		if err == nil {
+			inserted = append(inserted, rows...)
+			continue
+		}
+		force := false
+		if !isConditionDataError(err) {
+			// パケットが大きすぎるなど、エラー番号では分からないが行が原因で通らないものもある
+			// 続けて失敗していて、DBには繋がる場合だけ二分する
+			if !omConditionFlushFailures.Fail(rows) || db2.Ping() != nil {
+				pending = append(pending, rows...)
+				lastErr = err
+				continue
+			}
+			force = true
+		}
+		ok, rest, err := bisectIsuConditions(rows, err, force)
+		inserted = append(inserted, ok...)
+		if err != nil {
+			pending = append(pending, rest...)
+			lastErr = err
+		}
+	}
+	omConditionFlushFailures.Clear(inserted)
+	return inserted, pending, lastErr
+}
+
+// forceの場合は行に依らない失敗でも二分し、1行で失敗するものをdead letterに送る
+func bisectIsuConditions(isuConditions []*IsuCondition, cause error, force bool) ([]*IsuCondition, []*IsuCondition, error) {
+	if len(isuConditions) == 1 {
+		conditionDeadLetter.Put(isuConditions, cause)
+		omConditionFlushFailures.Clear(isuConditions)
+		return nil, nil, nil
+	}
+
+	inserted := []*IsuCondition{}
+	mid := len(isuConditions) / 2
+	halves := [][]*IsuCondition{isuConditions[:mid], isuConditions[mid:]}
+	for i, half := range halves {
+		var (
+			ok      []*IsuCondition
+			pending []*IsuCondition
+		)
+		err := insertIsuConditions(half)
+		if err == nil {
+			ok = half
+		} else if force || isConditionDataError(err) {
+			ok, pending, err = bisectIsuConditions(half, err, force)
+		} else {
+			pending = half
+		}
+		inserted = append(inserted, ok...)
+		if err != nil {
+			rest := append([]*IsuCondition{}, pending...)
+			if i == 0 {
+				rest = append(rest, halves[1]...)
+			}
+			return inserted, rest, err
+		}
+	}
+	return inserted, nil, nil
+}
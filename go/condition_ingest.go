@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// 既に受け付けたものを残し、後から来た同じ(jia_isu_uuid, timestamp)を捨てる
+	conditionDuplicatePolicyIgnore = "ignore"
+	// 後から来たもので上書きする
+	conditionDuplicatePolicyUpsert = "upsert"
+)
+
+var conditionDuplicatePolicy = conditionDuplicatePolicyIgnore
+
+// isu_condition.messageのVARCHAR(255)。超えるものはflushで必ず失敗するので受け付けない
+const maxConditionMessageLength = 255
+
+var (
+	errBadConditionRequest           = errors.New("bad condition request")
+	errConditionTimestampQuarantined = errors.New("quarantined: timestamp out of range")
+)
+
+// isu_conditionのPRIMARY KEY
+type isuConditionKey struct {
+	JIAIsuUUID string
+	Timestamp  int64
+}
+
+func isuConditionKeyOf(v *IsuCondition) isuConditionKey {
+	return isuConditionKey{JIAIsuUUID: v.JIAIsuUUID, Timestamp: v.Timestamp.Unix()}
+}
+
+// POST /api/condition/:jia_isu_uuid?result=items のレスポンス
+// それぞれリクエストの配列のindexを持つ
+type PostIsuConditionResponse struct {
+	Accepted    []int                  `json:"accepted"`
+	Duplicate   []int                  `json:"duplicate"`
+	Rejected    []RejectedIsuCondition `json:"rejected"`
+	Quarantined []int                  `json:"quarantined"`
+	Shed        []int                  `json:"shed"` // 負荷が高いため書き込まずに捨てたもの
+}
+
+type RejectedIsuCondition struct {
+	Index  int    `json:"index"`
+	Reason string `json:"reason"`
+}
+
+// リクエストの1件を検証してIsuConditionにする。不正な場合は理由を返す
+// policyはtimestampに適用したもの。隔離する場合はconditionSkewPolicyQuarantineになる
+func newIsuConditionFromRequest(jiaIsuUUID string, cond PostIsuConditionRequest, now time.Time) (*IsuCondition, string, string) {
+	if !isValidConditionFormat(cond.Condition) {
+		return nil, "bad format: condition", ""
+	}
+	if cond.Timestamp <= 0 {
+		return nil, "bad timestamp", ""
+	}
+	if utf8.RuneCountInString(cond.Message) > maxConditionMessageLength {
+		return nil, "message too long", ""
+	}
+	level, err := calculateConditionLevel(cond.Condition)
+	if err != nil {
+		return nil, err.Error(), ""
+	}
+
+	timestamp, policy := conditionTimestampWindow.Apply(time.Unix(cond.Timestamp, 0), now)
+	conditionSkew.Record(jiaIsuUUID, time.Unix(cond.Timestamp, 0), now, policy)
+	if policy == conditionSkewPolicyReject {
+		return nil, "timestamp out of range", policy
+	}
+
+	return &IsuCondition{
+		JIAIsuUUID: jiaIsuUUID,
+		Timestamp:  timestamp,
+		IsSitting:  cond.IsSitting,
+		Condition:  cond.Condition,
+		Message:    cond.Message,
+		Level:      level,
+	}, "", policy
+}
+
+// コンディションを検証してバッファに積む
+// allOrNothingの場合は1件でも不正なものがあれば何も積まずに errBadConditionRequest を返す
+// そうでない場合は1件毎の結果を返すので、DBに既にあるものもduplicateにする
+// ただしflushで書き込み中のものとの重複はacceptedになり、flush時に重複ポリシーで解決する
+func ingestIsuConditions(jiaIsuUUID string, req []PostIsuConditionRequest, allOrNothing bool) (PostIsuConditionResponse, error) {
+	res := PostIsuConditionResponse{
+		Accepted:    []int{},
+		Duplicate:   []int{},
+		Rejected:    []RejectedIsuCondition{},
+		Quarantined: []int{},
+		Shed:        []int{},
+	}
+
+	now := time.Now()
+	isuConditions := make([]*IsuCondition, 0, len(req))
+	indexes := make([]int, 0, len(req))
+	quarantined := []*IsuCondition{}
+	quarantinedIndexes := []int{}
+	clamped := map[int]bool{}
+	for i, cond := range req {
+		isuCondition, reason, policy := newIsuConditionFromRequest(jiaIsuUUID, cond, now)
+		if isuCondition == nil {
+			if allOrNothing {
+				return res, errBadConditionRequest
+			}
+			res.Rejected = append(res.Rejected, RejectedIsuCondition{Index: i, Reason: reason})
+			continue
+		}
+		if policy == conditionSkewPolicyQuarantine {
+			quarantined = append(quarantined, isuCondition)
+			quarantinedIndexes = append(quarantinedIndexes, i)
+			continue
+		}
+		if policy == conditionSkewPolicyClamp {
+			clamped[i] = true
+		}
+		isuConditions = append(isuConditions, isuCondition)
+		indexes = append(indexes, i)
+	}
+
+	// 負荷が高い場合は優先度の低いものを捨てる
+	shed := conditionShedder.Shed(isuConditions)
+	kept := isuConditions[:0]
+	keptIndexes := indexes[:0]
+	for i, isuCondition := range isuConditions {
+		if shed[i] {
+			res.Shed = append(res.Shed, indexes[i])
+			continue
+		}
+		kept = append(kept, isuCondition)
+		keptIndexes = append(keptIndexes, indexes[i])
+	}
+	isuConditions, indexes = kept, keptIndexes
+
+	// 範囲の端に寄せたtimestampが他のコンディションと重なったものは、送り直しても同じなので重複とは分ける
+	duplicate := func(index int) {
+		if clamped[index] {
+			res.Rejected = append(res.Rejected, RejectedIsuCondition{Index: index, Reason: "timestamp clamped onto another condition"})
+		} else {
+			res.Duplicate = append(res.Duplicate, index)
+		}
+	}
+
+	// 送り直しは大抵flushの後に届くので、DBにあるものとも比べる
+	storedIndexes := []int{}
+	stored := make([]bool, len(isuConditions))
+	if !allOrNothing && len(isuConditions) > 0 {
+		storedTimestamps, err := storedIsuConditionTimestamps(jiaIsuUUID, isuConditions)
+		if err != nil {
+			return res, err
+		}
+		kept, keptIndexes := isuConditions[:0], indexes[:0]
+		stored = stored[:0]
+		for i, isuCondition := range isuConditions {
+			_, ok := storedTimestamps[isuCondition.Timestamp.Unix()]
+			if ok && conditionDuplicatePolicy == conditionDuplicatePolicyIgnore {
+				// 書き込んでも捨てられるので積まない
+				storedIndexes = append(storedIndexes, indexes[i])
+				continue
+			}
+			kept = append(kept, isuCondition)
+			keptIndexes = append(keptIndexes, indexes[i])
+			stored = append(stored, ok)
+		}
+		isuConditions, indexes = kept, keptIndexes
+	}
+
+	if len(isuConditions) == 0 {
+		quarantineIsuConditions(&res, quarantined, quarantinedIndexes)
+		for _, index := range storedIndexes {
+			duplicate(index)
+		}
+		return res, nil
+	}
+
+	// バッファに積めなかった場合はリトライで同じものがまた来るので、隔離もしない
+	duplicated, err := omIsuConditionList.Set(isuConditions)
+	if err != nil {
+		if errors.Is(err, errConditionBufferFull) {
+			conditionBufferRejected.Add(int64(len(isuConditions)))
+		}
+		return res, err
+	}
+	quarantineIsuConditions(&res, quarantined, quarantinedIndexes)
+	for _, index := range storedIndexes {
+		duplicate(index)
+	}
+
+	accepted := make([]*IsuCondition, 0, len(isuConditions))
+	for i, index := range indexes {
+		if duplicated[i] || stored[i] {
+			duplicate(index)
+		} else {
+			res.Accepted = append(res.Accepted, index)
+			accepted = append(accepted, isuConditions[i])
+		}
+	}
+	conditionPriorityLane.Push(accepted)
+	return res, nil
+}
+
+// 確認してからdead letterのredriveで書き込めるように隔離しておく
+func quarantineIsuConditions(res *PostIsuConditionResponse, quarantined []*IsuCondition, indexes []int) {
+	if len(quarantined) == 0 {
+		return
+	}
+	conditionDeadLetter.Put(quarantined, errConditionTimestampQuarantined)
+	res.Quarantined = indexes
+}
+
+// isu_conditionに既にあるtimestamp
+func storedIsuConditionTimestamps(jiaIsuUUID string, isuConditions []*IsuCondition) (map[int64]struct{}, error) {
+	timestamps := make([]time.Time, 0, len(isuConditions))
+	for _, v := range isuConditions {
+		timestamps = append(timestamps, v.Timestamp)
+	}
+	query, params, err := sqlx.In("SELECT `timestamp` FROM `isu_condition` WHERE `jia_isu_uuid` = ? AND `timestamp` IN (?)", jiaIsuUUID, timestamps)
+	if err != nil {
+		return nil, err
+	}
+	stored := []time.Time{}
+	if err := db2.Select(&stored, db2.Rebind(query), params...); err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	res := make(map[int64]struct{}, len(stored))
+	for _, t := range stored {
+		res[t.Unix()] = struct{}{}
+	}
+	return res, nil
+}
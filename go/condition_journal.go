@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/goccy/go-json"
+)
+
+const conditionJournalSuffix = ".journal"
+
+// 受け付けたコンディションのバッチを追記していくジャーナル
+// シャード毎に持ち、conditionShard に積んだ内容をflushが終わるまでディスクに残しておき、落ちても起動時に再投入する
+type conditionJournalT struct {
+	M    sync.Mutex
+	Dir  string
+	Sync bool
+
+	seq  int64
+	file *os.File
+}
+
+// ジャーナルを開き、残っているセグメントの続きの番号から新しいセグメントを書き始める
+func (j *conditionJournalT) Open(dir string, sync bool) error {
+	j.M.Lock()
+	defer j.M.Unlock()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	j.Dir = dir
+	j.Sync = sync
+
+	seqs, err := listConditionJournalSeqs(dir)
+	if err != nil {
+		return err
+	}
+	if len(seqs) > 0 {
+		j.seq = seqs[len(seqs)-1]
+	}
+	return j.openNextSegment()
+}
+
+// dirにあるセグメントの番号を古い順に返す
+func listConditionJournalSeqs(dir string) ([]int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	seqs := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, conditionJournalSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(name, conditionJournalSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, k int) bool { return seqs[i] < seqs[k] })
+	return seqs, nil
+}
+
+// 前回のプロセスが残したセグメントのパスを返す
+// シャード数が変わっていても拾えるように、baseDir直下と全てのシャードのディレクトリを見る
+// ジャーナルを開く前に呼ぶ
+func listConditionJournalSegments(baseDir string) ([]string, error) {
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		return nil, err
+	}
+	dirs := []string{baseDir}
+	entries, err := os.ReadDir(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, filepath.Join(baseDir, entry.Name()))
+		}
+	}
+
+	segments := []string{}
+	for _, dir := range dirs {
+		seqs, err := listConditionJournalSeqs(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, seq := range seqs {
+			segments = append(segments, filepath.Join(dir, fmt.Sprintf("%020d%s", seq, conditionJournalSuffix)))
+		}
+	}
+	return segments, nil
+}
+
+func (j *conditionJournalT) segmentPath(seq int64) string {
+	return filepath.Join(j.Dir, fmt.Sprintf("%020d%s", seq, conditionJournalSuffix))
+}
+
+func (j *conditionJournalT) openNextSegment() error {
+	f, err := os.OpenFile(j.segmentPath(j.seq+1), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	j.seq++
+	j.file = f
+	return nil
+}
+
+// バッチを現在のセグメントに1行として追記する
+func (j *conditionJournalT) Append(v []*IsuCondition) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	j.M.Lock()
+	defer j.M.Unlock()
+	if j.file == nil {
+		return fmt.Errorf("condition journal is not open")
+	}
+	if _, err := j.file.Write(line); err != nil {
+		return err
+	}
+	if j.Sync {
+		return j.file.Sync()
+	}
+	return nil
+}
+
+// 新しいセグメントに切り替えてから現在のセグメントを閉じ、閉じたセグメントのパスを返す
+// 返したセグメントはflushが成功したらRemoveで消す
+// 新しいセグメントを開けない場合は現在のセグメントに書き続け、""を返す。次のflushでまた切り替える
+func (j *conditionJournalT) Rotate() (string, error) {
+	j.M.Lock()
+	defer j.M.Unlock()
+	if j.file == nil {
+		return "", fmt.Errorf("condition journal is not open")
+	}
+	old := j.file
+	if err := j.openNextSegment(); err != nil {
+		return "", err
+	}
+	// 閉じられなくても書いた内容はflushで書き込むので、セグメントは返す
+	if err := old.Close(); err != nil {
+		return old.Name(), err
+	}
+	return old.Name(), nil
+}
+
+func (j *conditionJournalT) Remove(segment string) {
+	removeConditionJournalSegment(segment)
+}
+
+func removeConditionJournalSegment(segment string) {
+	if segment == "" {
+		return
+	}
+	if err := os.Remove(segment); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+}
+
+func (j *conditionJournalT) Close() error {
+	j.M.Lock()
+	defer j.M.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// セグメントに残っているコンディションを読み出す
+// 書き込み途中で落ちた末尾の行は読み飛ばす
+func readConditionJournalSegment(segment string) ([]*IsuCondition, error) {
+	f, err := os.Open(segment)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := []*IsuCondition{}
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			batch := []*IsuCondition{}
+			if err := json.Unmarshal(line, &batch); err != nil {
+				log.Printf("skip broken journal line in %s: %v", segment, err)
+			} else {
+				res = append(res, batch...)
+			}
+		} else if len(line) > 0 {
+			log.Printf("skip truncated journal line in %s", segment)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// 前回のプロセスが残したセグメントをバッファに積み直してから消す
+func replayConditionJournal(segments []string) error {
+	for _, segment := range segments {
+		isuConditions, err := readConditionJournalSegment(segment)
+		if err != nil {
+			return err
+		}
+		if len(isuConditions) > 0 {
+			if err := omIsuConditionList.Restore(isuConditions); err != nil {
+				return err
+			}
+			log.Printf("replayed %d conditions from %s", len(isuConditions), segment)
+		}
+		removeConditionJournalSegment(segment)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultConditionPriorityLaneSize = 1024
+	conditionSubscriberBufferSize    = 64
+	conditionEventKeepAliveInterval  = 15 * time.Second
+)
+
+// criticalのコンディションをisu_conditionへのbulk INSERTを待たずにlatest_isu_conditionと購読者に届ける
+// isu_conditionへの書き込みはこれまで通りバッファから行う
+type conditionPriorityLaneT struct {
+	ch chan []*IsuCondition
+}
+
+var (
+	conditionPriorityLane  conditionPriorityLaneT
+	conditionPriorityStats = expvar.NewMap("condition_priority_lane")
+)
+
+func (l *conditionPriorityLaneT) Init(size int) {
+	l.ch = make(chan []*IsuCondition, size)
+}
+
+// バッファに積めたコンディションのうちcriticalのものを優先レーンに流す
+// レーンが詰まっている場合は諦め、通常のflushでの更新に任せる
+func (l *conditionPriorityLaneT) Push(v []*IsuCondition) {
+	if l.ch == nil {
+		return
+	}
+	critical := []*IsuCondition{}
+	for _, cond := range v {
+		if cond.Level == conditionLevelCritical {
+			critical = append(critical, cond)
+		}
+	}
+	if len(critical) == 0 {
+		return
+	}
+	select {
+	case l.ch <- critical:
+		conditionPriorityStats.Add("queued", int64(len(critical)))
+	default:
+		conditionPriorityStats.Add("overflow", int64(len(critical)))
+	}
+}
+
+// 溜まっている分をまとめてlatest_isu_conditionに書き込む
+// 保存されている行より新しい場合だけ更新するので、通常のflushと順番が入れ替わってもよい
+func (l *conditionPriorityLaneT) loop(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	for {
+		select {
+		case v := <-l.ch:
+		drain:
+			for {
+				select {
+				case more := <-l.ch:
+					v = append(v, more...)
+				default:
+					break drain
+				}
+			}
+			l.write(v)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (l *conditionPriorityLaneT) write(v []*IsuCondition) {
+	latest, err := upsertLatestIsuConditions(v)
+	if err != nil {
+		log.Printf("priority lane: %v", err)
+		conditionPriorityStats.Add("failed", int64(len(v)))
+		return
+	}
+	conditionPriorityStats.Add("written", int64(len(latest)))
+}
+
+// latest_isu_conditionが更新されたことをISUの持ち主に知らせる
+type conditionHubT struct {
+	M sync.RWMutex
+	V map[string]map[chan *GetIsuConditionResponse]struct{} // jia_user_id毎の購読者
+
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+var conditionHub = conditionHubT{
+	V:       map[string]map[chan *GetIsuConditionResponse]struct{}{},
+	closing: make(chan struct{}),
+}
+
+// サーバーを止めるときに購読中の接続を終わらせる
+func (h *conditionHubT) Close() {
+	h.closeOnce.Do(func() { close(h.closing) })
+}
+
+func (h *conditionHubT) Subscribe(jiaUserID string) chan *GetIsuConditionResponse {
+	ch := make(chan *GetIsuConditionResponse, conditionSubscriberBufferSize)
+	h.M.Lock()
+	if h.V[jiaUserID] == nil {
+		h.V[jiaUserID] = map[chan *GetIsuConditionResponse]struct{}{}
+	}
+	h.V[jiaUserID][ch] = struct{}{}
+	h.M.Unlock()
+	return ch
+}
+
+func (h *conditionHubT) Unsubscribe(jiaUserID string, ch chan *GetIsuConditionResponse) {
+	h.M.Lock()
+	delete(h.V[jiaUserID], ch)
+	if len(h.V[jiaUserID]) == 0 {
+		delete(h.V, jiaUserID)
+	}
+	h.M.Unlock()
+}
+
+// 購読者が読み切れていない場合は待たずに捨てる
+func (h *conditionHubT) Publish(v []*IsuCondition) {
+	h.M.RLock()
+	defer h.M.RUnlock()
+	if len(h.V) == 0 {
+		return
+	}
+	for _, cond := range v {
+		isu, ok := omIsu2.Get(cond.JIAIsuUUID)
+		if !ok {
+			continue
+		}
+		subscribers := h.V[isu.JIAUserID]
+		if len(subscribers) == 0 {
+			continue
+		}
+		event := &GetIsuConditionResponse{
+			JIAIsuUUID:     cond.JIAIsuUUID,
+			IsuName:        isu.Name,
+			Timestamp:      cond.Timestamp.Unix(),
+			IsSitting:      cond.IsSitting,
+			Condition:      cond.Condition,
+			ConditionLevel: cond.Level,
+			Message:        cond.Message,
+		}
+		for ch := range subscribers {
+			select {
+			case ch <- event:
+			default:
+				conditionPriorityStats.Add("subscriber_dropped", 1)
+			}
+		}
+	}
+}
+
+// GET /api/latest_condition/stream
+// 自分のISUの最新のコンディションが更新される度にServer-Sent Eventsで返す
+func getLatestConditionStream(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	ch := conditionHub.Subscribe(jiaUserID)
+	defer conditionHub.Unsubscribe(jiaUserID, ch)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	ticker := time.NewTicker(conditionEventKeepAliveInterval)
+	defer ticker.Stop()
+	ctx := c.Request().Context()
+	for {
+		select {
+		case event := <-ch:
+			b, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(res, "event: condition\ndata: %s\n\n", b); err != nil {
+				return nil
+			}
+			res.Flush()
+		case <-ticker.C:
+			if _, err := fmt.Fprint(res, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		case <-ctx.Done():
+			return nil
+		case <-conditionHub.closing:
+			return nil
+		}
+	}
+}
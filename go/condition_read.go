@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// DBから読んだ1台分のコンディションに、まだバッファにあるものを足す
+// 同じtimestampのものは重複ポリシーに従い、ignoreならDBの行を、upsertならバッファのものを使う
+// descならtimestampの降順、そうでなければ昇順に並べる
+func mergePendingIsuConditions(conditions []IsuCondition, pending []*IsuCondition, desc bool) []IsuCondition {
+	if len(pending) == 0 {
+		return conditions
+	}
+
+	index := make(map[int64]int, len(conditions))
+	for i, cond := range conditions {
+		index[cond.Timestamp.Unix()] = i
+	}
+	for _, cond := range pending {
+		if i, ok := index[cond.Timestamp.Unix()]; ok {
+			if conditionDuplicatePolicy == conditionDuplicatePolicyUpsert {
+				conditions[i] = *cond
+			}
+			continue
+		}
+		index[cond.Timestamp.Unix()] = len(conditions)
+		conditions = append(conditions, *cond)
+	}
+
+	sort.SliceStable(conditions, func(i, j int) bool {
+		if desc {
+			return conditions[i].Timestamp.After(conditions[j].Timestamp)
+		}
+		return conditions[i].Timestamp.Before(conditions[j].Timestamp)
+	})
+	return conditions
+}
+
+// getIsuConditionsFromDBと同じ条件でバッファにあるものを選ぶ
+func pendingIsuConditionsForList(jiaIsuUUID string, endTime time.Time, conditionLevel map[string]interface{}, startTime time.Time) []*IsuCondition {
+	return omIsuConditionList.Pending(jiaIsuUUID, func(cond *IsuCondition) bool {
+		if !cond.Timestamp.Before(endTime) {
+			return false
+		}
+		if !startTime.IsZero() && cond.Timestamp.Before(startTime) {
+			return false
+		}
+		_, ok := conditionLevel[cond.Level]
+		return ok
+	})
+}
+
+// [start, end)のバッファにあるものを選ぶ
+func pendingIsuConditionsBetween(jiaIsuUUID string, start, end time.Time) []*IsuCondition {
+	return omIsuConditionList.Pending(jiaIsuUUID, func(cond *IsuCondition) bool {
+		return !cond.Timestamp.Before(start) && cond.Timestamp.Before(end)
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// 捨てない
+	conditionShedModeOff = "off"
+	// バッファの埋まり具合とflushにかかる時間を見て捨てる
+	conditionShedModeAdaptive = "adaptive"
+
+	defaultConditionShedWarningPercent  = 50
+	defaultConditionShedCriticalPercent = 80
+	defaultConditionShedFlushLatencyMS  = 500
+
+	// flushにかかった時間の指数移動平均の重み
+	conditionFlushLatencyAlpha = 0.2
+)
+
+// 負荷の段階。上がるほど捨てるlevelが増える
+const (
+	conditionPressureNone = iota
+	// infoを捨てる
+	conditionPressureHigh
+	// infoとwarningを捨てる
+	conditionPressureSevere
+)
+
+type conditionShedderT struct {
+	M    sync.Mutex
+	Mode string
+	// バッファの上限に対する割合(%)。これを超えたらそれぞれの段階になる
+	WarningPercent  int
+	CriticalPercent int
+	// flushにかかる時間の目安。超えたらHigh、倍を超えたらSevere
+	FlushLatencyTarget time.Duration
+
+	flushLatency time.Duration // 指数移動平均
+}
+
+var (
+	conditionShedder = conditionShedderT{Mode: conditionShedModeOff}
+	conditionShed    = expvar.NewMap("condition_shed")
+)
+
+func loadConditionShedConfig() error {
+	conditionShedder.M.Lock()
+	defer conditionShedder.M.Unlock()
+	conditionShedder.Mode = getEnv("CONDITION_SHED_MODE", conditionShedModeOff)
+	switch conditionShedder.Mode {
+	case conditionShedModeOff, conditionShedModeAdaptive:
+	default:
+		return fmt.Errorf("invalid CONDITION_SHED_MODE: %s", conditionShedder.Mode)
+	}
+	conditionShedder.WarningPercent = getEnvInt("CONDITION_SHED_WARNING_PERCENT", defaultConditionShedWarningPercent)
+	conditionShedder.CriticalPercent = getEnvInt("CONDITION_SHED_CRITICAL_PERCENT", defaultConditionShedCriticalPercent)
+	conditionShedder.FlushLatencyTarget = time.Duration(getEnvInt("CONDITION_SHED_FLUSH_LATENCY_MS", defaultConditionShedFlushLatencyMS)) * time.Millisecond
+	return nil
+}
+
+// flushにかかった時間を記録する
+func (s *conditionShedderT) ObserveFlush(d time.Duration) {
+	s.M.Lock()
+	defer s.M.Unlock()
+	if s.flushLatency == 0 {
+		s.flushLatency = d
+		return
+	}
+	s.flushLatency = time.Duration(conditionFlushLatencyAlpha*float64(d) + (1-conditionFlushLatencyAlpha)*float64(s.flushLatency))
+}
+
+// 今の負荷の段階
+func (s *conditionShedderT) Pressure() int {
+	s.M.Lock()
+	mode, warning, critical, target, latency := s.Mode, s.WarningPercent, s.CriticalPercent, s.FlushLatencyTarget, s.flushLatency
+	s.M.Unlock()
+	if mode != conditionShedModeAdaptive {
+		return conditionPressureNone
+	}
+
+	pressure := conditionPressureNone
+	entries, bytes := omIsuConditionList.Depth()
+	fill := 0
+	if omIsuConditionList.MaxEntries > 0 {
+		fill = entries * 100 / omIsuConditionList.MaxEntries
+	}
+	if omIsuConditionList.MaxBytes > 0 && bytes*100/omIsuConditionList.MaxBytes > fill {
+		fill = bytes * 100 / omIsuConditionList.MaxBytes
+	}
+	if critical > 0 && fill >= critical {
+		pressure = conditionPressureSevere
+	} else if warning > 0 && fill >= warning {
+		pressure = conditionPressureHigh
+	}
+
+	if target > 0 {
+		if latency >= 2*target {
+			pressure = conditionPressureSevere
+		} else if latency >= target && pressure < conditionPressureHigh {
+			pressure = conditionPressureHigh
+		}
+	}
+	return pressure
+}
+
+func shouldShedConditionLevel(pressure int, level string) bool {
+	switch level {
+	case conditionLevelInfo:
+		return pressure >= conditionPressureHigh
+	case conditionLevelWarning:
+		return pressure >= conditionPressureSevere
+	}
+	// criticalは捨てない
+	return false
+}
+
+// 負荷に応じて捨てるものを選ぶ。捨てるものはtrueになる
+// latest_isu_conditionがずれないように、ISU毎に一番新しいものは残す
+func (s *conditionShedderT) Shed(v []*IsuCondition) []bool {
+	shed := make([]bool, len(v))
+	pressure := s.Pressure()
+	if pressure == conditionPressureNone {
+		return shed
+	}
+
+	newest := map[string]time.Time{}
+	for _, cond := range v {
+		if t, ok := newest[cond.JIAIsuUUID]; !ok || cond.Timestamp.After(t) {
+			newest[cond.JIAIsuUUID] = cond.Timestamp
+		}
+	}
+	for i, cond := range v {
+		if cond.Timestamp.Equal(newest[cond.JIAIsuUUID]) {
+			continue
+		}
+		if shouldShedConditionLevel(pressure, cond.Level) {
+			shed[i] = true
+			conditionShed.Add(cond.Level, 1)
+		}
+	}
+	return shed
+}
+
+func init() {
+	expvar.Publish("condition_shed_state", expvar.Func(func() interface{} {
+		conditionShedder.M.Lock()
+		mode, latency := conditionShedder.Mode, conditionShedder.flushLatency
+		conditionShedder.M.Unlock()
+		return map[string]interface{}{
+			"mode":             mode,
+			"pressure":         conditionShedder.Pressure(),
+			"flush_latency_ms": latency.Milliseconds(),
+		}
+	}))
+}
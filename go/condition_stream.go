@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	defaultConditionStreamAckItems      = 100
+	defaultConditionStreamAckIntervalMS = 1000
+	maxConditionStreamLineBytes         = 1 << 20
+)
+
+var (
+	conditionStreamAckItems    int
+	conditionStreamAckInterval time.Duration
+
+	// サーバーを止めるときに閉じる。受信中のストリームは最後のackを返して終わる
+	conditionStreamClosing   = make(chan struct{})
+	conditionStreamCloseOnce sync.Once
+
+	errConditionStreamLineTooLong = errors.New("line too long")
+)
+
+// e.Shutdownが終わらなくならないように、続いているストリームを終わらせる
+func closeConditionStreams() {
+	conditionStreamCloseOnce.Do(func() { close(conditionStreamClosing) })
+}
+
+// ストリームで受け取った1件。デコードに失敗した場合はErrを持つ
+type conditionStreamItem struct {
+	Req PostIsuConditionRequest
+	Err error
+}
+
+// ストリームに定期的に返す受け付け結果
+// indexはストリームの先頭から数えた通し番号
+type ConditionStreamAck struct {
+	Received    int                    `json:"received"`
+	Accepted    []int                  `json:"accepted"`
+	Duplicate   []int                  `json:"duplicate"`
+	Rejected    []RejectedIsuCondition `json:"rejected"`
+	Quarantined []int                  `json:"quarantined"`
+	Shed        []int                  `json:"shed"`
+	RetryAfter  int                    `json:"retry_after,omitempty"`
+}
+
+func newConditionStreamAck() ConditionStreamAck {
+	return ConditionStreamAck{Accepted: []int{}, Duplicate: []int{}, Rejected: []RejectedIsuCondition{}, Quarantined: []int{}, Shed: []int{}}
+}
+
+// itemsをまとめてバッファに積み、ackItems件毎かackInterval毎にwriteAckを呼ぶ
+// itemsが閉じられるかサーバーを止める場合は、残りを積んで最後のackを返して終わる
+func runConditionStream(isu *Isu, items <-chan conditionStreamItem, writeAck func(ConditionStreamAck) error) error {
+	ticker := time.NewTicker(conditionStreamAckInterval)
+	defer ticker.Stop()
+
+	received := 0
+	offset := 0
+	batch := []PostIsuConditionRequest{}
+	ack := newConditionStreamAck()
+
+	flush := func() error {
+		if len(batch) > 0 {
+			commitConditionStreamBatch(isu, batch, offset, &ack)
+		}
+		offset = received
+		batch = batch[:0]
+		if len(ack.Accepted) == 0 && len(ack.Duplicate) == 0 && len(ack.Rejected) == 0 && len(ack.Quarantined) == 0 && len(ack.Shed) == 0 {
+			return nil
+		}
+		ack.Received = received
+		err := writeAck(ack)
+		ack = newConditionStreamAck()
+		return err
+	}
+
+	for {
+		select {
+		case item, ok := <-items:
+			if !ok {
+				return flush()
+			}
+			if item.Err != nil {
+				// 壊れた行はバッチに入れずにその場で弾く
+				if len(batch) > 0 {
+					commitConditionStreamBatch(isu, batch, offset, &ack)
+					batch = batch[:0]
+				}
+				reason := "bad format: json"
+				if errors.Is(item.Err, errConditionStreamLineTooLong) {
+					reason = item.Err.Error()
+				}
+				ack.Rejected = append(ack.Rejected, RejectedIsuCondition{Index: received, Reason: reason})
+				received++
+				offset = received
+				continue
+			}
+			batch = append(batch, item.Req)
+			received++
+			if len(batch) >= conditionStreamAckItems {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				return err
+			}
+		case <-conditionStreamClosing:
+			return flush()
+		}
+	}
+}
+
+// postIsuConditionと同じ検証をしてバッファに積み、結果をackに足す
+func commitConditionStreamBatch(isu *Isu, batch []PostIsuConditionRequest, offset int, ack *ConditionStreamAck) {
+	rejectAll := func(reason string) {
+		for i := range batch {
+			ack.Rejected = append(ack.Rejected, RejectedIsuCondition{Index: offset + i, Reason: reason})
+		}
+	}
+
+	rateLimitRes := conditionRateLimiter.Allow(isu, len(batch))
+	if !rateLimitRes.Allowed {
+		rejectAll("too many conditions")
+		ack.RetryAfter = int(math.Ceil(rateLimitRes.RetryAfter.Seconds()))
+		return
+	}
+
+	res, err := ingestIsuConditions(isu.JIAIsuUUID, batch, false)
+	if err != nil {
+		if errors.Is(err, errConditionBufferFull) {
+			rejectAll("condition buffer is full")
+			ack.RetryAfter = conditionBufferRetryAfter
+			return
+		}
+		log.Printf("ingest error: %v", err)
+		rejectAll("internal error")
+		return
+	}
+	for _, i := range res.Accepted {
+		ack.Accepted = append(ack.Accepted, offset+i)
+	}
+	for _, i := range res.Duplicate {
+		ack.Duplicate = append(ack.Duplicate, offset+i)
+	}
+	for _, i := range res.Quarantined {
+		ack.Quarantined = append(ack.Quarantined, offset+i)
+	}
+	for _, i := range res.Shed {
+		ack.Shed = append(ack.Shed, offset+i)
+	}
+	for _, r := range res.Rejected {
+		ack.Rejected = append(ack.Rejected, RejectedIsuCondition{Index: offset + r.Index, Reason: r.Reason})
+	}
+}
+
+// HTTP/1.1でもリクエストボディを読みながらレスポンスを書けるようにする
+// HTTP/2は元から読みながら書ける。対応していないGoのバージョンではfalseを返す
+func enableFullDuplex(r *http.Request, w http.ResponseWriter) bool {
+	if r.ProtoMajor >= 2 {
+		return true
+	}
+	fd, ok := w.(interface{ EnableFullDuplex() error })
+	if !ok {
+		return false
+	}
+	return fd.EnableFullDuplex() == nil
+}
+
+// POST /api/condition/:jia_isu_uuid/stream
+// ISUからのコンディションを改行区切りのJSONで受け取り続ける
+func postIsuConditionStream(c echo.Context) error {
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	if jiaIsuUUID == "" {
+		return c.String(http.StatusBadRequest, "missing: jia_isu_uuid")
+	}
+	isu, ok := omIsu2.Get(jiaIsuUUID)
+	if !ok {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+	if err := verifyDeviceRequest(c, jiaIsuUUID, false); err != nil {
+		return deviceAuthErrorResponse(c, err)
+	}
+	// ackをボディの終わりまで返せないとISUは送ったものの結果を待てないので、WebSocketを使ってもらう
+	if !enableFullDuplex(c.Request(), c.Response().Writer) {
+		return c.String(http.StatusBadRequest, "streaming is not supported: use GET /api/condition/"+jiaIsuUUID+"/stream (WebSocket)")
+	}
+
+	items := make(chan conditionStreamItem)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(items)
+		scanner := bufio.NewScanner(c.Request().Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxConditionStreamLineBytes)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			item := conditionStreamItem{}
+			item.Err = json.Unmarshal(line, &item.Req)
+			select {
+			case items <- item:
+			case <-done:
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			if errors.Is(err, bufio.ErrTooLong) {
+				// 長すぎる行の先は読めないので、その行を弾いて終わる
+				select {
+				case items <- conditionStreamItem{Err: errConditionStreamLineTooLong}:
+				case <-done:
+				}
+			}
+			log.Printf("condition stream closed: jia_isu_uuid=%s err=%v", jiaIsuUUID, err)
+		}
+	}()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	writeAck := func(ack ConditionStreamAck) error {
+		if !res.Committed {
+			res.WriteHeader(http.StatusOK)
+		}
+		if err := json.NewEncoder(res).Encode(ack); err != nil {
+			return err
+		}
+		res.Flush()
+		return nil
+	}
+
+	if err := runConditionStream(isu, items, writeAck); err != nil {
+		log.Printf("condition stream aborted: jia_isu_uuid=%s err=%v", jiaIsuUUID, err)
+		return nil
+	}
+	if !res.Committed {
+		res.WriteHeader(http.StatusOK)
+	}
+	return nil
+}
+
+// GET /api/condition/:jia_isu_uuid/stream
+// ISUからのコンディションをWebSocketで受け取り続ける
+// 1メッセージにコンディション1件のオブジェクトか、複数件の配列を入れる
+func getIsuConditionStream(c echo.Context) error {
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	if jiaIsuUUID == "" {
+		return c.String(http.StatusBadRequest, "missing: jia_isu_uuid")
+	}
+	isu, ok := omIsu2.Get(jiaIsuUUID)
+	if !ok {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+	if err := verifyDeviceRequest(c, jiaIsuUUID, false); err != nil {
+		return deviceAuthErrorResponse(c, err)
+	}
+
+	server := websocket.Server{
+		// ISUはOriginを送ってこないので検証しない
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			items := make(chan conditionStreamItem)
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				defer close(items)
+				for {
+					var msg []byte
+					if err := websocket.Message.Receive(ws, &msg); err != nil {
+						return
+					}
+					for _, item := range decodeConditionStreamMessage(msg) {
+						select {
+						case items <- item:
+						case <-done:
+							return
+						}
+					}
+				}
+			}()
+
+			writeAck := func(ack ConditionStreamAck) error {
+				b, err := json.Marshal(ack)
+				if err != nil {
+					return err
+				}
+				return websocket.Message.Send(ws, string(b))
+			}
+			if err := runConditionStream(isu, items, writeAck); err != nil {
+				log.Printf("condition stream aborted: jia_isu_uuid=%s err=%v", jiaIsuUUID, err)
+			}
+		},
+	}
+	server.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// 配列の場合は要素毎にデコードし、壊れた要素だけを弾く
+// 配列として読めない場合は件数が分からないので、メッセージ全体を1件として弾く
+func decodeConditionStreamMessage(msg []byte) []conditionStreamItem {
+	msg = bytes.TrimSpace(msg)
+	if len(msg) > 0 && msg[0] == '[' {
+		raws := []json.RawMessage{}
+		if err := json.Unmarshal(msg, &raws); err != nil {
+			return []conditionStreamItem{{Err: err}}
+		}
+		items := make([]conditionStreamItem, len(raws))
+		for i, raw := range raws {
+			items[i].Err = json.Unmarshal(raw, &items[i].Req)
+		}
+		return items
+	}
+	item := conditionStreamItem{}
+	item.Err = json.Unmarshal(msg, &item.Req)
+	return []conditionStreamItem{item}
+}
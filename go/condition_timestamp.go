@@ -0,0 +1,134 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// 窓の外のコンディションを弾く
+	conditionSkewPolicyReject = "reject"
+	// 窓の端に丸めて受け付ける
+	conditionSkewPolicyClamp = "clamp"
+	// 書き込まずにdead letterに隔離する
+	conditionSkewPolicyQuarantine = "quarantine"
+)
+
+// サーバー時刻から見て受け付けるtimestampの範囲
+// MaxFuture/MaxPastが0ならその向きは制限しない
+type conditionTimestampWindowT struct {
+	MaxFuture    time.Duration
+	MaxPast      time.Duration
+	FuturePolicy string
+	PastPolicy   string
+}
+
+var conditionTimestampWindow = conditionTimestampWindowT{
+	FuturePolicy: conditionSkewPolicyReject,
+	PastPolicy:   conditionSkewPolicyReject,
+}
+
+func loadConditionTimestampWindow() error {
+	conditionTimestampWindow = conditionTimestampWindowT{
+		MaxFuture:    time.Duration(getEnvInt("CONDITION_MAX_FUTURE_SKEW_SEC", 0)) * time.Second,
+		MaxPast:      time.Duration(getEnvInt("CONDITION_MAX_PAST_SKEW_SEC", 0)) * time.Second,
+		FuturePolicy: getEnv("CONDITION_FUTURE_SKEW_POLICY", conditionSkewPolicyReject),
+		PastPolicy:   getEnv("CONDITION_PAST_SKEW_POLICY", conditionSkewPolicyReject),
+	}
+	for _, policy := range []string{conditionTimestampWindow.FuturePolicy, conditionTimestampWindow.PastPolicy} {
+		switch policy {
+		case conditionSkewPolicyReject, conditionSkewPolicyClamp, conditionSkewPolicyQuarantine:
+		default:
+			return fmt.Errorf("invalid skew policy: %s", policy)
+		}
+	}
+	return nil
+}
+
+// timestampを窓に照らして、使うtimestampと適用したポリシーを返す。窓の中なら空文字
+func (w conditionTimestampWindowT) Apply(timestamp, now time.Time) (time.Time, string) {
+	if w.MaxFuture > 0 && timestamp.After(now.Add(w.MaxFuture)) {
+		if w.FuturePolicy == conditionSkewPolicyClamp {
+			return now.Add(w.MaxFuture), w.FuturePolicy
+		}
+		return timestamp, w.FuturePolicy
+	}
+	if w.MaxPast > 0 && timestamp.Before(now.Add(-w.MaxPast)) {
+		if w.PastPolicy == conditionSkewPolicyClamp {
+			return now.Add(-w.MaxPast), w.PastPolicy
+		}
+		return timestamp, w.PastPolicy
+	}
+	return timestamp, ""
+}
+
+// ISU毎のtimestampのずれの統計。ずれは timestamp - サーバー時刻 を秒で持つ
+type conditionSkewStats struct {
+	Count       int64 `json:"count"`
+	Future      int64 `json:"future"`
+	Past        int64 `json:"past"`
+	MaxFuture   int64 `json:"max_future"`
+	MaxPast     int64 `json:"max_past"`
+	Last        int64 `json:"last"`
+	Rejected    int64 `json:"rejected"`
+	Clamped     int64 `json:"clamped"`
+	Quarantined int64 `json:"quarantined"`
+}
+
+type conditionSkewStatsT struct {
+	M sync.Mutex
+	V map[string]*conditionSkewStats
+}
+
+var conditionSkew = conditionSkewStatsT{V: map[string]*conditionSkewStats{}}
+
+func (s *conditionSkewStatsT) Record(jiaIsuUUID string, timestamp, now time.Time, policy string) {
+	skew := int64(timestamp.Sub(now) / time.Second)
+
+	s.M.Lock()
+	defer s.M.Unlock()
+	stats, ok := s.V[jiaIsuUUID]
+	if !ok {
+		stats = &conditionSkewStats{}
+		s.V[jiaIsuUUID] = stats
+	}
+	stats.Count++
+	stats.Last = skew
+	if skew > 0 {
+		stats.Future++
+		if skew > stats.MaxFuture {
+			stats.MaxFuture = skew
+		}
+	} else if skew < 0 {
+		stats.Past++
+		if -skew > stats.MaxPast {
+			stats.MaxPast = -skew
+		}
+	}
+	switch policy {
+	case conditionSkewPolicyReject:
+		stats.Rejected++
+	case conditionSkewPolicyClamp:
+		stats.Clamped++
+	case conditionSkewPolicyQuarantine:
+		stats.Quarantined++
+	}
+}
+
+func (s *conditionSkewStatsT) Snapshot() map[string]conditionSkewStats {
+	s.M.Lock()
+	defer s.M.Unlock()
+	res := make(map[string]conditionSkewStats, len(s.V))
+	for k, v := range s.V {
+		res[k] = *v
+	}
+	return res
+}
+
+func init() {
+	expvar.Publish("condition_timestamp_skew", expvar.Func(func() interface{} {
+		return conditionSkew.Snapshot()
+	}))
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// ISUからのリクエストを検証しない
+	deviceAuthModeOff = "off"
+	// 認証情報が付いている場合だけ検証する
+	deviceAuthModeOptional = "optional"
+	// 認証情報が無いリクエストを弾く
+	deviceAuthModeRequired = "required"
+
+	deviceSignatureHeader = "X-Isu-Signature"
+	deviceTimestampHeader = "X-Isu-Timestamp"
+
+	defaultDeviceAuthMaxSkewSec        = 300
+	defaultDeviceCredentialGraceSec    = 3600
+	deviceSecretBytes                  = 32
+	deviceAuthReplayCacheSweepInterval = time.Minute
+)
+
+var (
+	deviceAuthMode           = deviceAuthModeOff
+	deviceAuthMaxSkew        time.Duration
+	deviceCredentialGrace    time.Duration
+	errDeviceUnauthorized    = errors.New("unauthorized device")
+	errDeviceReplayedRequest = errors.New("replayed request")
+)
+
+// ISU毎の認証情報。ローテーション直後は猶予期間の間だけ一つ前のsecretも受け付ける
+type IsuDeviceCredential struct {
+	JIAIsuUUID        string         `db:"jia_isu_uuid"`
+	Secret            string         `db:"secret"`
+	PreviousSecret    sql.NullString `db:"previous_secret"`
+	PreviousExpiresAt sql.NullTime   `db:"previous_expires_at"`
+	RotatedAt         time.Time      `db:"rotated_at"`
+}
+
+type RotateDeviceCredentialResponse struct {
+	DeviceSecret      string `json:"device_secret"`
+	PreviousExpiresAt int64  `json:"previous_expires_at"`
+}
+
+// 有効なsecretの一覧
+func (v *IsuDeviceCredential) secrets(now time.Time) []string {
+	secrets := []string{v.Secret}
+	if v.PreviousSecret.Valid && v.PreviousExpiresAt.Valid && now.Before(v.PreviousExpiresAt.Time) {
+		secrets = append(secrets, v.PreviousSecret.String)
+	}
+	return secrets
+}
+
+type omIsuCredentialT struct {
+	M sync.RWMutex
+	V map[string]*IsuDeviceCredential
+}
+
+var omIsuCredential = omIsuCredentialT{V: map[string]*IsuDeviceCredential{}}
+
+func (o *omIsuCredentialT) Get(jiaIsuUUID string) (*IsuDeviceCredential, bool) {
+	o.M.RLock()
+	v, ok := o.V[jiaIsuUUID]
+	o.M.RUnlock()
+	return v, ok
+}
+
+func (o *omIsuCredentialT) Set(v *IsuDeviceCredential) {
+	o.M.Lock()
+	o.V[v.JIAIsuUUID] = v
+	o.M.Unlock()
+}
+
+func (o *omIsuCredentialT) Load() error {
+	credentials := []*IsuDeviceCredential{}
+	if err := db.Select(&credentials, "SELECT * FROM `isu_device_credential`"); err != nil {
+		return err
+	}
+	v := make(map[string]*IsuDeviceCredential, len(credentials))
+	for _, credential := range credentials {
+		v[credential.JIAIsuUUID] = credential
+	}
+	o.M.Lock()
+	o.V = v
+	o.M.Unlock()
+	return nil
+}
+
+// 一度通った署名を有効期限まで覚えておき、同じリクエストの再送を弾く
+type deviceReplayCacheT struct {
+	M         sync.Mutex
+	V         map[string]time.Time
+	lastSweep time.Time
+}
+
+var deviceReplayCache = deviceReplayCacheT{V: map[string]time.Time{}}
+
+func (r *deviceReplayCacheT) CheckAndStore(signature string, expiresAt, now time.Time) bool {
+	r.M.Lock()
+	defer r.M.Unlock()
+	if now.Sub(r.lastSweep) > deviceAuthReplayCacheSweepInterval {
+		for k, v := range r.V {
+			if now.After(v) {
+				delete(r.V, k)
+			}
+		}
+		r.lastSweep = now
+	}
+	if v, ok := r.V[signature]; ok && now.Before(v) {
+		return false
+	}
+	r.V[signature] = expiresAt
+	return true
+}
+
+func loadDeviceAuthConfig() error {
+	deviceAuthMode = getEnv("DEVICE_AUTH_MODE", deviceAuthModeOff)
+	switch deviceAuthMode {
+	case deviceAuthModeOff, deviceAuthModeOptional, deviceAuthModeRequired:
+	default:
+		return fmt.Errorf("invalid DEVICE_AUTH_MODE: %s", deviceAuthMode)
+	}
+	deviceAuthMaxSkew = time.Duration(getEnvInt("DEVICE_AUTH_MAX_SKEW_SEC", defaultDeviceAuthMaxSkewSec)) * time.Second
+	deviceCredentialGrace = time.Duration(getEnvInt("DEVICE_CREDENTIAL_GRACE_SEC", defaultDeviceCredentialGraceSec)) * time.Second
+	return nil
+}
+
+func generateDeviceSecret() (string, error) {
+	b := make([]byte, deviceSecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ISUの登録時に認証情報を発行する
+func issueDeviceCredential(tx *sqlx.Tx, jiaIsuUUID string) (*IsuDeviceCredential, error) {
+	secret, err := generateDeviceSecret()
+	if err != nil {
+		return nil, err
+	}
+	credential := &IsuDeviceCredential{
+		JIAIsuUUID: jiaIsuUUID,
+		Secret:     secret,
+		RotatedAt:  time.Now(),
+	}
+	_, err = tx.Exec("INSERT INTO `isu_device_credential` (`jia_isu_uuid`, `secret`, `rotated_at`) VALUES (?, ?, ?)"+
+		" ON DUPLICATE KEY UPDATE `secret` = VALUES(`secret`), `previous_secret` = NULL, `previous_expires_at` = NULL, `rotated_at` = VALUES(`rotated_at`)",
+		credential.JIAIsuUUID, credential.Secret, credential.RotatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+// 署名するメッセージ。ストリーミングのエンドポイントではボディを空として扱う
+func deviceSignatureMessage(timestamp string, body []byte) []byte {
+	msg := make([]byte, 0, len(timestamp)+1+len(body))
+	msg = append(msg, timestamp...)
+	msg = append(msg, '.')
+	return append(msg, body...)
+}
+
+func signDeviceRequest(secret string, msg []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(msg)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ISUからのリクエストを検証する
+//
+//	X-Isu-Timestamp: <unix秒>
+//	X-Isu-Signature: hex(HMAC-SHA256(secret, "<X-Isu-Timestamp>.<body>"))
+//
+// 時刻がずれすぎているものと、同じ署名が2回来たものは弾く
+// secretをそのまま送るBearerは盗まれたら何度でも使えるので受け付けない
+//
+// signBodyがfalseの場合はボディを空として検証する。ストリームで使い、確かめられるのは接続を開いたのが
+// secretを持つISUで、その署名が初めて使われたことまで。接続後に流れてくる各行は署名されないので、改ざんへの備えはTLSに任せる
+// ボディを読んだ場合は後で読めるように戻しておく
+func verifyDeviceRequest(c echo.Context, jiaIsuUUID string, signBody bool) error {
+	if deviceAuthMode == deviceAuthModeOff {
+		return nil
+	}
+
+	req := c.Request()
+	signature := req.Header.Get(deviceSignatureHeader)
+	if signature == "" {
+		if deviceAuthMode == deviceAuthModeOptional {
+			return nil
+		}
+		return errDeviceUnauthorized
+	}
+
+	credential, ok := omIsuCredential.Get(jiaIsuUUID)
+	if !ok {
+		return errDeviceUnauthorized
+	}
+	now := time.Now()
+	secrets := credential.secrets(now)
+
+	timestampStr := req.Header.Get(deviceTimestampHeader)
+	timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
+	if err != nil {
+		return errDeviceUnauthorized
+	}
+	signedAt := time.Unix(timestamp, 0)
+	if signedAt.Before(now.Add(-deviceAuthMaxSkew)) || signedAt.After(now.Add(deviceAuthMaxSkew)) {
+		return errDeviceUnauthorized
+	}
+
+	var body []byte
+	if signBody {
+		body, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	msg := deviceSignatureMessage(timestampStr, body)
+	for _, secret := range secrets {
+		if hmac.Equal([]byte(signature), []byte(signDeviceRequest(secret, msg))) {
+			if !deviceReplayCache.CheckAndStore(jiaIsuUUID+":"+signature, signedAt.Add(deviceAuthMaxSkew), now) {
+				return errDeviceReplayedRequest
+			}
+			return nil
+		}
+	}
+	return errDeviceUnauthorized
+}
+
+// 検証に失敗した場合のレスポンス
+func deviceAuthErrorResponse(c echo.Context, err error) error {
+	if errors.Is(err, errDeviceUnauthorized) || errors.Is(err, errDeviceReplayedRequest) {
+		return c.String(http.StatusUnauthorized, err.Error())
+	}
+	c.Logger().Error(err)
+	return c.NoContent(http.StatusInternalServerError)
+}
+
+// POST /api/isu/:jia_isu_uuid/device_credential
+// ISUの認証情報をローテーションする。一つ前のsecretは猶予期間の間だけ有効
+func postIsuDeviceCredential(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	if _, ok := omIsu.Get(jiaIsuUUID, jiaUserID); !ok {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
+	secret, err := generateDeviceSecret()
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	now := time.Now()
+	credential := &IsuDeviceCredential{
+		JIAIsuUUID: jiaIsuUUID,
+		Secret:     secret,
+		RotatedAt:  now,
+	}
+	if current, ok := omIsuCredential.Get(jiaIsuUUID); ok {
+		credential.PreviousSecret = sql.NullString{String: current.Secret, Valid: true}
+		credential.PreviousExpiresAt = sql.NullTime{Time: now.Add(deviceCredentialGrace), Valid: true}
+	}
+
+	_, err = db.Exec("INSERT INTO `isu_device_credential` (`jia_isu_uuid`, `secret`, `previous_secret`, `previous_expires_at`, `rotated_at`) VALUES (?, ?, ?, ?, ?)"+
+		" ON DUPLICATE KEY UPDATE `secret` = VALUES(`secret`), `previous_secret` = VALUES(`previous_secret`), `previous_expires_at` = VALUES(`previous_expires_at`), `rotated_at` = VALUES(`rotated_at`)",
+		credential.JIAIsuUUID, credential.Secret, credential.PreviousSecret, credential.PreviousExpiresAt, credential.RotatedAt)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	omIsuCredential.Set(credential)
+
+	res := RotateDeviceCredentialResponse{DeviceSecret: credential.Secret}
+	if credential.PreviousExpiresAt.Valid {
+		res.PreviousExpiresAt = credential.PreviousExpiresAt.Time.Unix()
+	}
+	return c.JSON(http.StatusOK, res)
+}
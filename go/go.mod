@@ -8,7 +8,12 @@ require (
 	github.com/goccy/go-json v0.9.8
 	github.com/gorilla/sessions v1.2.1
 	github.com/jmoiron/sqlx v1.3.4
+	github.com/klauspost/compress v1.15.15
 	github.com/labstack/echo/v4 v4.6.1
 	github.com/labstack/gommon v0.3.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d
+	golang.org/x/net v0.0.0-20210913180222-943fd674d43e
 	golang.org/x/sync v0.0.0-20220601150217-0de741cfad7f
+	google.golang.org/protobuf v1.28.1
 )
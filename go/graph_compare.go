@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultGraphCompareMaxIsus       = 20
+	defaultGraphCompareDBConcurrency = 4
+)
+
+var (
+	// 1回の比較で指定できるISUの数の上限
+	graphCompareMaxIsus = defaultGraphCompareMaxIsus
+	// 全ての比較リクエストで共有する、同時にisu_conditionを読むISUの数
+	// db2のコネクションを比較だけで使い切らないようにする
+	graphCompareDBSemaphore chan struct{}
+
+	graphCompareStats = expvar.NewMap("graph_compare")
+)
+
+func loadGraphCompareConfig() {
+	graphCompareMaxIsus = getEnvInt("GRAPH_COMPARE_MAX_ISUS", defaultGraphCompareMaxIsus)
+	concurrency := getEnvInt("GRAPH_COMPARE_DB_CONCURRENCY", defaultGraphCompareDBConcurrency)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	graphCompareDBSemaphore = make(chan struct{}, concurrency)
+}
+
+type IsuCompareGraph struct {
+	JIAIsuUUID string          `json:"jia_isu_uuid"`
+	IsuName    string          `json:"isu_name"`
+	Graph      []GraphResponse `json:"graph"`
+}
+
+// 全てのISUのGraphは同じ区切りで並ぶ
+type GetIsuCompareGraphResponse struct {
+	StartAt int64             `json:"start_at"`
+	EndAt   int64             `json:"end_at"`
+	Isu     []IsuCompareGraph `json:"isu"`
+}
+
+// GET /api/compare/graph
+// 複数のISUのグラフを同じ区切りで並べて取得
+// jia_isu_uuidを繰り返すか、group_idでグループのISUを指定する。期間の指定は GET /api/isu/:jia_isu_uuid/graph と同じ
+func getIsuCompareGraph(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	loc, err := requestLocation(c, jiaUserID)
+	if err != nil {
+		if errors.Is(err, errBadTimezone) {
+			return c.String(http.StatusBadRequest, "bad format: tz")
+		}
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	boundaries, err := parseGraphRange(c.QueryParam("datetime"), c.QueryParam("start"), c.QueryParam("end"), c.QueryParam("resolution"), c.QueryParam("buckets"), loc)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	withStats, err := parseGraphStatsParam(c.QueryParam("stats"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	model := currentScoringModel()
+	if err := checkGraphRawRange(boundaries, model, withStats); err != nil {
+		return graphRawRangeErrorResponse(c, err)
+	}
+
+	jiaIsuUUIDs := uniqueStrings(c.QueryParams()["jia_isu_uuid"])
+	if groupIDStr := c.QueryParam("group_id"); groupIDStr != "" {
+		groupID, err := strconv.ParseInt(groupIDStr, 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: group_id")
+		}
+		groupIsuUUIDs, ok, err := isuGroupIsuUUIDs(groupID, jiaUserID)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if !ok {
+			return c.String(http.StatusNotFound, "not found: group")
+		}
+		jiaIsuUUIDs = uniqueStrings(append(jiaIsuUUIDs, groupIsuUUIDs...))
+	}
+	if len(jiaIsuUUIDs) == 0 {
+		return c.String(http.StatusBadRequest, "missing: jia_isu_uuid")
+	}
+	if graphCompareMaxIsus > 0 && len(jiaIsuUUIDs) > graphCompareMaxIsus {
+		return c.String(http.StatusBadRequest, "too many isu: max "+strconv.Itoa(graphCompareMaxIsus))
+	}
+
+	isuList, ok, err := visibleIsuList(jiaUserID, jiaIsuUUIDs)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !ok {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
+	graphs, err := generateIsuCompareGraphs(c, isuList, boundaries, model, withStats)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, GetIsuCompareGraphResponse{
+		StartAt: boundaries[0].Unix(),
+		EndAt:   boundaries[len(boundaries)-1].Unix(),
+		Isu:     graphs,
+	})
+}
+
+// ISU毎のグラフを並行して計算する。同時に計算するのはgraphCompareDBSemaphoreの分だけ
+// 全てのISUで同じスコアの計算方法を使う
+func generateIsuCompareGraphs(c echo.Context, isuList []*Isu, boundaries []time.Time, model *scoringModel, withStats bool) ([]IsuCompareGraph, error) {
+	ctx := c.Request().Context()
+	graphs := make([]IsuCompareGraph, len(isuList))
+	errs := make([]error, len(isuList))
+	var wg sync.WaitGroup
+	for i, isu := range isuList {
+		graphs[i] = IsuCompareGraph{JIAIsuUUID: isu.JIAIsuUUID, IsuName: isu.Name}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			waitStart := time.Now()
+			select {
+			case graphCompareDBSemaphore <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			defer func() { <-graphCompareDBSemaphore }()
+			graphCompareStats.Add("wait_ms", time.Since(waitStart).Milliseconds())
+			graphCompareStats.Add("isu", 1)
+			graphs[i].Graph, errs[i] = generateIsuGraphResponse(db2, graphs[i].JIAIsuUUID, boundaries, model, withStats)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return graphs, nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	graphFormatJSON = "json"
+	graphFormatCSV  = "csv"
+	graphFormatSVG  = "svg"
+	graphFormatPNG  = "png"
+
+	graphChartWidth        = 960
+	graphChartHeight       = 360
+	graphChartMarginLeft   = 48
+	graphChartMarginRight  = 16
+	graphChartMarginTop    = 48
+	graphChartMarginBottom = 40
+	graphChartXTicks       = 6
+)
+
+// チャートに描く線。スコアと4つの割合
+type graphChartSeries struct {
+	Name  string
+	Color color.RGBA
+	Width int
+	Value func(*GraphDataPoint) int
+}
+
+var graphChartSeriesList = []graphChartSeries{
+	{Name: "score", Color: color.RGBA{0x25, 0x63, 0xeb, 0xff}, Width: 3, Value: func(v *GraphDataPoint) int { return v.Score }},
+	{Name: "sitting", Color: color.RGBA{0x16, 0xa3, 0x4a, 0xff}, Width: 1, Value: func(v *GraphDataPoint) int { return v.Percentage.Sitting }},
+	{Name: "is_broken", Color: color.RGBA{0xdc, 0x26, 0x26, 0xff}, Width: 1, Value: func(v *GraphDataPoint) int { return v.Percentage.IsBroken }},
+	{Name: "is_dirty", Color: color.RGBA{0xa1, 0x62, 0x07, 0xff}, Width: 1, Value: func(v *GraphDataPoint) int { return v.Percentage.IsDirty }},
+	{Name: "is_overweight", Color: color.RGBA{0x93, 0x33, 0xea, 0xff}, Width: 1, Value: func(v *GraphDataPoint) int { return v.Percentage.IsOverweight }},
+}
+
+var (
+	graphChartGridColor = color.RGBA{0xe5, 0xe7, 0xeb, 0xff}
+	graphChartTextColor = color.RGBA{0x37, 0x41, 0x51, 0xff}
+)
+
+func isValidGraphFormat(format string) bool {
+	switch format {
+	case "", graphFormatJSON, graphFormatCSV, graphFormatSVG, graphFormatPNG:
+		return true
+	}
+	return false
+}
+
+// formatに従ってグラフを返す
+func writeIsuGraph(c echo.Context, isu *Isu, res []GraphResponse, format string, loc *time.Location) error {
+	filename := fmt.Sprintf("%s-graph.%s", isu.JIAIsuUUID, format)
+	switch format {
+	case graphFormatCSV:
+		b, err := renderGraphCSV(res, loc)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+		return c.Blob(http.StatusOK, "text/csv; charset=utf-8", b)
+	case graphFormatSVG:
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("inline; filename=%q", filename))
+		return c.Blob(http.StatusOK, "image/svg+xml", renderGraphSVG(isu.Name, res, loc))
+	case graphFormatPNG:
+		b, err := renderGraphPNG(isu.JIAIsuUUID, res, loc)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("inline; filename=%q", filename))
+		return c.Blob(http.StatusOK, "image/png", b)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// データ点1つを1行にする。データが無い区間は値を空にする
+func renderGraphCSV(res []GraphResponse, loc *time.Location) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	header := []string{"start_at", "end_at", "condition_count"}
+	for _, series := range graphChartSeriesList {
+		header = append(header, series.Name)
+	}
+	header = append(header, "source", "scoring_model")
+	if err := w.Write(header); err != nil {
+		return nil, err
+	}
+	for _, graph := range res {
+		record := []string{
+			time.Unix(graph.StartAt, 0).In(loc).Format(time.RFC3339),
+			time.Unix(graph.EndAt, 0).In(loc).Format(time.RFC3339),
+			strconv.Itoa(graph.ConditionCount),
+		}
+		for _, series := range graphChartSeriesList {
+			if graph.Data == nil {
+				record = append(record, "")
+				continue
+			}
+			record = append(record, strconv.Itoa(series.Value(graph.Data)))
+		}
+		record = append(record, graph.Source)
+		if graph.Data == nil {
+			record = append(record, "")
+		} else {
+			record = append(record, graph.Data.ScoringModel)
+		}
+		if err := w.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// チャートの座標
+type graphChartLayout struct {
+	N int // データ点の数
+}
+
+func (l graphChartLayout) plotWidth() int {
+	return graphChartWidth - graphChartMarginLeft - graphChartMarginRight
+}
+
+func (l graphChartLayout) plotHeight() int {
+	return graphChartHeight - graphChartMarginTop - graphChartMarginBottom
+}
+
+// i番目のデータ点の真ん中
+func (l graphChartLayout) x(i int) int {
+	return graphChartMarginLeft + (2*i+1)*l.plotWidth()/(2*l.N)
+}
+
+// 0から100の値
+func (l graphChartLayout) y(v int) int {
+	return graphChartMarginTop + l.plotHeight()*(100-v)/100
+}
+
+// 目盛りを付けるデータ点のindex
+func (l graphChartLayout) xTicks() []int {
+	ticks := []int{}
+	step := (l.N + graphChartXTicks - 1) / graphChartXTicks
+	if step < 1 {
+		step = 1
+	}
+	for i := 0; i < l.N; i += step {
+		ticks = append(ticks, i)
+	}
+	return ticks
+}
+
+// 期間が長い場合は日付だけにする
+func graphChartTimeFormat(res []GraphResponse) string {
+	if len(res) > 0 && res[len(res)-1].EndAt-res[0].StartAt > 2*24*60*60 {
+		return "2006/01/02"
+	}
+	return "01/02 15:04"
+}
+
+// データのある区間が続いている部分毎に、線の頂点を返す
+func graphChartSegments(l graphChartLayout, res []GraphResponse, series graphChartSeries) [][]image.Point {
+	segments := [][]image.Point{}
+	segment := []image.Point{}
+	for i, graph := range res {
+		if graph.Data == nil {
+			if len(segment) > 0 {
+				segments = append(segments, segment)
+				segment = []image.Point{}
+			}
+			continue
+		}
+		segment = append(segment, image.Pt(l.x(i), l.y(series.Value(graph.Data))))
+	}
+	if len(segment) > 0 {
+		segments = append(segments, segment)
+	}
+	return segments
+}
+
+func graphChartTitle(name string, res []GraphResponse, loc *time.Location) string {
+	if len(res) == 0 {
+		return name
+	}
+	layout := "2006/01/02 15:04"
+	return fmt.Sprintf("%s  %s - %s (%s)", name,
+		time.Unix(res[0].StartAt, 0).In(loc).Format(layout),
+		time.Unix(res[len(res)-1].EndAt, 0).In(loc).Format(layout),
+		loc.String())
+}
+
+func svgColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func renderGraphSVG(name string, res []GraphResponse, loc *time.Location) []byte {
+	l := graphChartLayout{N: len(res)}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`,
+		graphChartWidth, graphChartHeight, graphChartWidth, graphChartHeight)
+	fmt.Fprintf(b, `<rect width="100%%" height="100%%" fill="#ffffff"/>`)
+	fmt.Fprintf(b, `<text x="%d" y="16" font-size="13" fill="%s">%s</text>`, graphChartMarginLeft, svgColor(graphChartTextColor), html.EscapeString(graphChartTitle(name, res, loc)))
+
+	x := graphChartMarginLeft
+	for _, series := range graphChartSeriesList {
+		fmt.Fprintf(b, `<rect x="%d" y="26" width="12" height="4" fill="%s"/>`, x, svgColor(series.Color))
+		fmt.Fprintf(b, `<text x="%d" y="32" fill="%s">%s</text>`, x+16, svgColor(graphChartTextColor), series.Name)
+		x += 16 + len(series.Name)*7 + 16
+	}
+
+	for v := 0; v <= 100; v += 25 {
+		fmt.Fprintf(b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="%s"/>`, graphChartMarginLeft, l.y(v), graphChartWidth-graphChartMarginRight, l.y(v), svgColor(graphChartGridColor))
+		fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="end" fill="%s">%d</text>`, graphChartMarginLeft-6, l.y(v)+4, svgColor(graphChartTextColor), v)
+	}
+	if l.N > 0 {
+		timeFormat := graphChartTimeFormat(res)
+		for _, i := range l.xTicks() {
+			fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="middle" fill="%s">%s</text>`, l.x(i), graphChartHeight-graphChartMarginBottom+16, svgColor(graphChartTextColor),
+				time.Unix(res[i].StartAt, 0).In(loc).Format(timeFormat))
+		}
+	}
+
+	for _, series := range graphChartSeriesList {
+		for _, segment := range graphChartSegments(l, res, series) {
+			if len(segment) == 1 {
+				fmt.Fprintf(b, `<circle cx="%d" cy="%d" r="%d" fill="%s"/>`, segment[0].X, segment[0].Y, series.Width+1, svgColor(series.Color))
+				continue
+			}
+			points := make([]string, 0, len(segment))
+			for _, p := range segment {
+				points = append(points, fmt.Sprintf("%d,%d", p.X, p.Y))
+			}
+			fmt.Fprintf(b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="%d" stroke-linejoin="round"/>`, strings.Join(points, " "), svgColor(series.Color), series.Width)
+		}
+	}
+	b.WriteString(`</svg>`)
+	return []byte(b.String())
+}
+
+// basicfontはASCIIしか持たないので、タイトルにはISUの名前の代わりにjia_isu_uuidを使う
+func renderGraphPNG(jiaIsuUUID string, res []GraphResponse, loc *time.Location) ([]byte, error) {
+	l := graphChartLayout{N: len(res)}
+	img := image.NewRGBA(image.Rect(0, 0, graphChartWidth, graphChartHeight))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+
+	drawText := func(s string, x, y int, c color.RGBA) {
+		d := &font.Drawer{Dst: img, Src: image.NewUniform(c), Face: basicfont.Face7x13, Dot: fixed.P(x, y)}
+		d.DrawString(s)
+	}
+	textWidth := func(s string) int {
+		return font.MeasureString(basicfont.Face7x13, s).Round()
+	}
+
+	drawText(graphChartTitle(jiaIsuUUID, res, loc), graphChartMarginLeft, 16, graphChartTextColor)
+	x := graphChartMarginLeft
+	for _, series := range graphChartSeriesList {
+		draw.Draw(img, image.Rect(x, 26, x+12, 30), image.NewUniform(series.Color), image.Point{}, draw.Src)
+		drawText(series.Name, x+16, 32, graphChartTextColor)
+		x += 16 + textWidth(series.Name) + 16
+	}
+
+	for v := 0; v <= 100; v += 25 {
+		drawPNGLine(img, image.Pt(graphChartMarginLeft, l.y(v)), image.Pt(graphChartWidth-graphChartMarginRight, l.y(v)), graphChartGridColor, 1)
+		label := strconv.Itoa(v)
+		drawText(label, graphChartMarginLeft-6-textWidth(label), l.y(v)+4, graphChartTextColor)
+	}
+	if l.N > 0 {
+		timeFormat := graphChartTimeFormat(res)
+		for _, i := range l.xTicks() {
+			label := time.Unix(res[i].StartAt, 0).In(loc).Format(timeFormat)
+			drawText(label, l.x(i)-textWidth(label)/2, graphChartHeight-graphChartMarginBottom+16, graphChartTextColor)
+		}
+	}
+
+	for _, series := range graphChartSeriesList {
+		for _, segment := range graphChartSegments(l, res, series) {
+			if len(segment) == 1 {
+				p := segment[0]
+				r := series.Width + 1
+				draw.Draw(img, image.Rect(p.X-r, p.Y-r, p.X+r+1, p.Y+r+1), image.NewUniform(series.Color), image.Point{}, draw.Src)
+				continue
+			}
+			for i := 0; i+1 < len(segment); i++ {
+				drawPNGLine(img, segment[i], segment[i+1], series.Color, series.Width)
+			}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Bresenhamで線を引く。太さの分だけ点を正方形にする
+func drawPNGLine(img *image.RGBA, from, to image.Point, c color.RGBA, width int) {
+	dx, dy := abs(to.X-from.X), -abs(to.Y-from.Y)
+	sx, sy := 1, 1
+	if from.X > to.X {
+		sx = -1
+	}
+	if from.Y > to.Y {
+		sy = -1
+	}
+	half := width / 2
+	e := dx + dy
+	for p := from; ; {
+		for ox := -half; ox <= width-1-half; ox++ {
+			for oy := -half; oy <= width-1-half; oy++ {
+				img.SetRGBA(p.X+ox, p.Y+oy, c)
+			}
+		}
+		if p == to {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			p.X += sx
+		}
+		if e2 <= dx {
+			e += dx
+			p.Y += sy
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
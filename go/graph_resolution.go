@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultGraphResolution   = "1h"
+	defaultGraphMaxBuckets   = 288
+	defaultGraphMaxRangeDays = 366
+
+	// start/endを指定した場合に自動で選ぶ
+	graphResolutionAuto = "auto"
+
+	// データ点をisu_conditionの行から計算した
+	graphSourceRaw = "raw"
+)
+
+// GET /api/isu/:jia_isu_uuid/graph で選べるデータ点の幅と、bucketsを省略した場合に覆う日数
+// 1時間以下は経過時間で区切り、6時間以上はタイムゾーンの暦で区切る
+// そのため夏時間の切り替わる日は1時間毎なら23個か25個、1日毎なら23時間か25時間の区間になる
+type graphResolution struct {
+	Width    time.Duration
+	SpanDays int
+}
+
+var graphResolutions = map[string]graphResolution{
+	"5m":  {Width: 5 * time.Minute, SpanDays: 1},
+	"15m": {Width: 15 * time.Minute, SpanDays: 1},
+	"1h":  {Width: time.Hour, SpanDays: 1},
+	"6h":  {Width: 6 * time.Hour, SpanDays: 7},
+	"1d":  {Width: 24 * time.Hour, SpanDays: 7},
+	"1w":  {Width: 7 * 24 * time.Hour, SpanDays: 53 * 7},
+}
+
+// autoで選ぶ順。細かいものから
+var graphAutoResolutions = []string{"5m", "15m", "1h", "6h", "1d", "1w"}
+
+var (
+	// 1回のリクエストで返すデータ点の個数の上限
+	graphMaxBuckets = defaultGraphMaxBuckets
+	// start/endで指定できる期間の上限
+	graphMaxRange = defaultGraphMaxRangeDays * 24 * time.Hour
+)
+
+// tを含むデータ点の始まり
+func (r graphResolution) floor(t time.Time, loc *time.Location) time.Time {
+	lt := t.In(loc)
+	switch {
+	case r.Width < time.Hour:
+		// タイムゾーンのずれは15分の倍数なのでそのまま切り捨てられる
+		return t.Truncate(r.Width)
+	case r.Width == time.Hour:
+		// 夏時間が終わって同じ時刻が2回ある場合もあるので、時計の分と秒を引く
+		return t.Add(-time.Duration(lt.Minute())*time.Minute - time.Duration(lt.Second())*time.Second - time.Duration(lt.Nanosecond()))
+	case r.Width < 24*time.Hour:
+		hours := int(r.Width / time.Hour)
+		return time.Date(lt.Year(), lt.Month(), lt.Day(), lt.Hour()/hours*hours, 0, 0, 0, loc)
+	case r.Width == 24*time.Hour:
+		return time.Date(lt.Year(), lt.Month(), lt.Day(), 0, 0, 0, 0, loc)
+	default:
+		// 週は月曜始まり
+		return time.Date(lt.Year(), lt.Month(), lt.Day()-(int(lt.Weekday())+6)%7, 0, 0, 0, 0, loc)
+	}
+}
+
+// tから始まるデータ点の終わり
+func (r graphResolution) next(t time.Time, loc *time.Location) time.Time {
+	if r.Width <= time.Hour {
+		return t.Add(r.Width)
+	}
+	lt := t.In(loc)
+	if r.Width < 24*time.Hour {
+		return time.Date(lt.Year(), lt.Month(), lt.Day(), lt.Hour()+int(r.Width/time.Hour), 0, 0, 0, loc)
+	}
+	return time.Date(lt.Year(), lt.Month(), lt.Day()+int(r.Width/(24*time.Hour)), 0, 0, 0, 0, loc)
+}
+
+// startからデータ点の区切りを並べる。n個並べるかendに達したら終わり
+// 区切りがmaxを超える場合はfalseを返す
+func (r graphResolution) boundaries(start time.Time, n int, end time.Time, loc *time.Location, max int) ([]time.Time, bool) {
+	boundaries := []time.Time{start}
+	for t := start; ; {
+		if n > 0 && len(boundaries) > n {
+			break
+		}
+		if n <= 0 && !t.Before(end) {
+			break
+		}
+		if max > 0 && len(boundaries) > max {
+			return nil, false
+		}
+		t = r.next(t, loc)
+		boundaries = append(boundaries, t)
+	}
+	return boundaries, true
+}
+
+// GET /api/isu/:jia_isu_uuid/graph のクエリパラメータからデータ点の区切りを決める
+// 区切りはデータ点の数+1個で、i番目のデータ点は[Boundaries[i], Boundaries[i+1])
+// datetimeを指定した場合はそこからbuckets個。省略した場合はresolution毎の日数分
+// start/endを指定した場合はその期間を覆うようにし、resolutionを省略するかautoならbucketsが上限に収まる一番細かいものを選ぶ
+func parseGraphRange(datetimeStr, startStr, endStr, resolutionStr, bucketsStr string, loc *time.Location) ([]time.Time, error) {
+	if startStr == "" && endStr == "" {
+		if datetimeStr == "" {
+			return nil, fmt.Errorf("missing: datetime")
+		}
+		datetime, err := strconv.ParseInt(datetimeStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad format: datetime")
+		}
+		if resolutionStr == "" {
+			resolutionStr = defaultGraphResolution
+		}
+		resolution, ok := graphResolutions[resolutionStr]
+		if !ok {
+			return nil, fmt.Errorf("bad format: resolution")
+		}
+		buckets := 0
+		if bucketsStr != "" {
+			buckets, err = strconv.Atoi(bucketsStr)
+			if err != nil || buckets < 1 {
+				return nil, fmt.Errorf("bad format: buckets")
+			}
+		}
+
+		start := resolution.floor(time.Unix(datetime, 0), loc)
+		lt := start.In(loc)
+		end := time.Date(lt.Year(), lt.Month(), lt.Day()+resolution.SpanDays, lt.Hour(), lt.Minute(), 0, 0, loc)
+		boundaries, ok := resolution.boundaries(start, buckets, end, loc, graphMaxBuckets)
+		if !ok {
+			return nil, fmt.Errorf("too many buckets: max %d", graphMaxBuckets)
+		}
+		return boundaries, nil
+	}
+
+	if startStr == "" {
+		return nil, fmt.Errorf("missing: start")
+	}
+	if endStr == "" {
+		return nil, fmt.Errorf("missing: end")
+	}
+	if bucketsStr != "" {
+		return nil, fmt.Errorf("buckets cannot be used with start and end")
+	}
+	startInt64, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad format: start")
+	}
+	endInt64, err := strconv.ParseInt(endStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad format: end")
+	}
+	start, end := time.Unix(startInt64, 0), time.Unix(endInt64, 0)
+	if !start.Before(end) {
+		return nil, fmt.Errorf("end must be after start")
+	}
+	if graphMaxRange > 0 && end.Sub(start) > graphMaxRange {
+		return nil, fmt.Errorf("range too long: max %d days", int(graphMaxRange/(24*time.Hour)))
+	}
+
+	candidates := graphAutoResolutions
+	if resolutionStr != "" && resolutionStr != graphResolutionAuto {
+		if _, ok := graphResolutions[resolutionStr]; !ok {
+			return nil, fmt.Errorf("bad format: resolution")
+		}
+		candidates = []string{resolutionStr}
+	}
+	for _, name := range candidates {
+		resolution := graphResolutions[name]
+		if boundaries, ok := resolution.boundaries(resolution.floor(start, loc), 0, end, loc, graphMaxBuckets); ok {
+			return boundaries, nil
+		}
+	}
+	return nil, fmt.Errorf("too many buckets: max %d", graphMaxBuckets)
+}
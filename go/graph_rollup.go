@@ -0,0 +1,396 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// データ点をisu_condition_hourlyから計算した
+	graphSourceRollup = "rollup"
+
+	// 1回の集計し直しでまとめる(jia_isu_uuid, 時間)の組の数
+	isuConditionHourlyRefreshChunk = 200
+
+	defaultGraphMaxRawRangeDays          = 7
+	defaultGraphRollupTimestampsMaxHours = 24
+
+	// 集計を作り直している間に長い期間のグラフを求められた場合のRetry-After(秒)
+	graphRollupNotReadyRetryAfter = 5
+)
+
+var (
+	// isu_conditionの行から計算する場合に指定できる期間の上限
+	graphMaxRawRange = defaultGraphMaxRawRangeDays * 24 * time.Hour
+	// 集計から返す場合に、これより長い期間ではcondition_timestampsを返さない
+	graphRollupTimestampsMaxRange = defaultGraphRollupTimestampsMaxHours * time.Hour
+)
+
+var isuConditionHourlyStats = expvar.NewMap("isu_condition_hourly")
+
+var (
+	// isu_condition_hourlyを作り直し終えるまでは0。集計を使わずにisu_conditionから計算する
+	// 起動時も前回からの集計が揃っているとは限らないので、起動時の作り直しが終わってから1になる
+	isuConditionHourlyReady int32
+	// 最後に始めた作り直しの番号。古い作り直しが終わってもreadyにしない
+	isuConditionHourlyBackfillGen int64
+	isuConditionHourlyBackfillM   sync.Mutex
+	// 作り直しが終わるまではisu_conditionの行を全て読まないと計算できない
+	errIsuConditionHourlyNotReady = errors.New("hourly aggregation is being rebuilt: retry later")
+
+	// 失敗したdirtyのリトライを1つのシャードだけがする
+	isuConditionHourlyRetrying int32
+)
+
+// 集計し直せなかった(jia_isu_uuid, 時間)。次のflushでやり直し、それまでグラフはisu_conditionから計算する
+type omIsuConditionHourlyDirtyT struct {
+	M sync.Mutex
+	V map[isuConditionHour]struct{}
+}
+
+var omIsuConditionHourlyDirty = omIsuConditionHourlyDirtyT{V: map[isuConditionHour]struct{}{}}
+
+func (o *omIsuConditionHourlyDirtyT) Add(hours []isuConditionHour) {
+	o.M.Lock()
+	defer o.M.Unlock()
+	for _, h := range hours {
+		o.V[h] = struct{}{}
+	}
+}
+
+func (o *omIsuConditionHourlyDirtyT) Remove(hours []isuConditionHour) {
+	o.M.Lock()
+	defer o.M.Unlock()
+	for _, h := range hours {
+		delete(o.V, h)
+	}
+}
+
+func (o *omIsuConditionHourlyDirtyT) List() []isuConditionHour {
+	o.M.Lock()
+	defer o.M.Unlock()
+	hours := make([]isuConditionHour, 0, len(o.V))
+	for h := range o.V {
+		hours = append(hours, h)
+	}
+	return hours
+}
+
+// ISUのdirtyな時間
+func (o *omIsuConditionHourlyDirtyT) Hours(jiaIsuUUID string) []time.Time {
+	o.M.Lock()
+	defer o.M.Unlock()
+	hours := []time.Time{}
+	for h := range o.V {
+		if h.JIAIsuUUID == jiaIsuUUID {
+			hours = append(hours, h.Hour)
+		}
+	}
+	return hours
+}
+
+func init() {
+	expvar.Publish("isu_condition_hourly_dirty", expvar.Func(func() interface{} {
+		omIsuConditionHourlyDirty.M.Lock()
+		defer omIsuConditionHourlyDirty.M.Unlock()
+		return len(omIsuConditionHourlyDirty.V)
+	}))
+}
+
+// ISU毎、1時間毎のコンディションの集計
+type IsuConditionHourly struct {
+	JIAIsuUUID        string    `db:"jia_isu_uuid"`
+	Hour              time.Time `db:"hour"`
+	ConditionCount    int       `db:"condition_count"`
+	SittingCount      int       `db:"sitting_count"`
+	IsDirtyCount      int       `db:"is_dirty_count"`
+	IsOverweightCount int       `db:"is_overweight_count"`
+	IsBrokenCount     int       `db:"is_broken_count"`
+	RawScoreSum       int       `db:"raw_score_sum"`
+}
+
+// isu_conditionのうちwhereに当てはまる行を集計してisu_condition_hourlyに書き込む文
+// 時間の中の行を全て数え直すので、遅れて届いたものや上書きされたものも正しく反映される
+func isuConditionHourlyRefreshQuery(where string) string {
+	return "INSERT INTO `isu_condition_hourly`" +
+		" (`jia_isu_uuid`, `hour`, `condition_count`, `sitting_count`, `is_dirty_count`, `is_overweight_count`, `is_broken_count`, `raw_score_sum`)" +
+		" SELECT `jia_isu_uuid`, DATE_FORMAT(`timestamp`, '%Y-%m-%d %H:00:00') AS `hour`, COUNT(*), SUM(`is_sitting`)," +
+		" SUM(`condition` LIKE '%is_dirty=true%'), SUM(`condition` LIKE '%is_overweight=true%'), SUM(`condition` LIKE '%is_broken=true%')," +
+		fmt.Sprintf(" SUM(CASE `level` WHEN '%s' THEN %d WHEN '%s' THEN %d ELSE %d END)",
+			conditionLevelCritical, scoreConditionLevelCritical, conditionLevelWarning, scoreConditionLevelWarning, scoreConditionLevelInfo) +
+		" FROM `isu_condition` WHERE " + where + " GROUP BY `jia_isu_uuid`, `hour`" +
+		" ON DUPLICATE KEY UPDATE `condition_count` = VALUES(`condition_count`), `sitting_count` = VALUES(`sitting_count`)," +
+		" `is_dirty_count` = VALUES(`is_dirty_count`), `is_overweight_count` = VALUES(`is_overweight_count`)," +
+		" `is_broken_count` = VALUES(`is_broken_count`), `raw_score_sum` = VALUES(`raw_score_sum`)"
+}
+
+type isuConditionHour struct {
+	JIAIsuUUID string
+	Hour       time.Time
+}
+
+// 書き込んだコンディションを含む時間を集計し直す
+// 失敗した時間はdirtyにして、retryIsuConditionHourlyDirtyでやり直す
+func refreshIsuConditionHourly(isuConditions []*IsuCondition) error {
+	seen := map[isuConditionHour]struct{}{}
+	hours := []isuConditionHour{}
+	for _, cond := range isuConditions {
+		h := isuConditionHour{JIAIsuUUID: cond.JIAIsuUUID, Hour: cond.Timestamp.Truncate(time.Hour)}
+		if _, ok := seen[h]; ok {
+			continue
+		}
+		seen[h] = struct{}{}
+		hours = append(hours, h)
+	}
+	return refreshIsuConditionHours(hours)
+}
+
+// dirtyな時間を集計し直す。他のシャードがやり直している間は何もしない
+func retryIsuConditionHourlyDirty() {
+	if !atomic.CompareAndSwapInt32(&isuConditionHourlyRetrying, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&isuConditionHourlyRetrying, 0)
+	hours := omIsuConditionHourlyDirty.List()
+	if len(hours) == 0 {
+		return
+	}
+	if err := refreshIsuConditionHours(hours); err != nil {
+		log.Printf("failed to retry isu_condition_hourly: %v", err)
+	}
+}
+
+func refreshIsuConditionHours(hours []isuConditionHour) error {
+	for start := 0; start < len(hours); start += isuConditionHourlyRefreshChunk {
+		end := start + isuConditionHourlyRefreshChunk
+		if end > len(hours) {
+			end = len(hours)
+		}
+		where := make([]string, 0, end-start)
+		args := make([]interface{}, 0, (end-start)*3)
+		for _, h := range hours[start:end] {
+			where = append(where, "(`jia_isu_uuid` = ? AND `timestamp` >= ? AND `timestamp` < ?)")
+			args = append(args, h.JIAIsuUUID, h.Hour, h.Hour.Add(time.Hour))
+		}
+		if _, err := db2.Exec(isuConditionHourlyRefreshQuery(strings.Join(where, " OR ")), args...); err != nil {
+			isuConditionHourlyStats.Add("refresh_failed", int64(len(hours)-start))
+			omIsuConditionHourlyDirty.Add(hours[start:])
+			return err
+		}
+		omIsuConditionHourlyDirty.Remove(hours[start:end])
+		isuConditionHourlyStats.Add("refreshed", int64(end-start))
+	}
+	return nil
+}
+
+// isu_condition_hourlyをisu_conditionの内容から作り直す
+// 1台ずつ集計してロックを長く持たないようにする
+func backfillIsuConditionHourly() error {
+	jiaIsuUUIDs := []string{}
+	if err := db2.Select(&jiaIsuUUIDs, "SELECT DISTINCT `jia_isu_uuid` FROM `isu_condition`"); err != nil {
+		return err
+	}
+	for _, jiaIsuUUID := range jiaIsuUUIDs {
+		if _, err := db2.Exec(isuConditionHourlyRefreshQuery("`jia_isu_uuid` = ?"), jiaIsuUUID); err != nil {
+			return err
+		}
+	}
+	log.Printf("backfilled isu_condition_hourly for %d isu", len(jiaIsuUUIDs))
+	return nil
+}
+
+// isu_condition_hourlyをバックグラウンドで作り直す。終わるまでグラフはisu_conditionから計算する
+// 作り直しの途中でもう一度呼ばれた場合は、後から始めたものが終わったときにreadyにする
+func startIsuConditionHourlyBackfill() {
+	gen := atomic.AddInt64(&isuConditionHourlyBackfillGen, 1)
+	atomic.StoreInt32(&isuConditionHourlyReady, 0)
+	go func() {
+		isuConditionHourlyBackfillM.Lock()
+		defer isuConditionHourlyBackfillM.Unlock()
+		if atomic.LoadInt64(&isuConditionHourlyBackfillGen) != gen {
+			return
+		}
+		if err := backfillIsuConditionHourly(); err != nil {
+			// readyにしないので、次の/initializeまでisu_conditionから計算する
+			log.Printf("failed to backfill isu_condition_hourly: %v", err)
+			return
+		}
+		if atomic.LoadInt64(&isuConditionHourlyBackfillGen) == gen {
+			atomic.StoreInt32(&isuConditionHourlyReady, 1)
+		}
+	}()
+}
+
+// 集計からグラフのデータ点を計算する。デフォルトの計算方法のcalculateGraphDataPointと同じ値になる
+func graphDataPointFromHourly(v IsuConditionHourly, model *scoringModel) GraphDataPoint {
+	return GraphDataPoint{
+		Score:        v.RawScoreSum * 100 / 3 / v.ConditionCount,
+		ScoringModel: model.Version,
+		Percentage: ConditionsPercentage{
+			Sitting:      v.SittingCount * 100 / v.ConditionCount,
+			IsBroken:     v.IsBrokenCount * 100 / v.ConditionCount,
+			IsOverweight: v.IsOverweightCount * 100 / v.ConditionCount,
+			IsDirty:      v.IsDirtyCount * 100 / v.ConditionCount,
+		},
+	}
+}
+
+// 集計を使えるのは全ての区切りが時間の境目に揃っていて、スコアの計算方法が集計と同じ場合
+// 作り直している間は使わない
+func canUseIsuConditionHourly(boundaries []time.Time, model *scoringModel) bool {
+	return atomic.LoadInt32(&isuConditionHourlyReady) == 1 && isuConditionHourlyCompatible(boundaries, model)
+}
+
+func isuConditionHourlyCompatible(boundaries []time.Time, model *scoringModel) bool {
+	if !model.rollupCompatible() {
+		return false
+	}
+	for _, t := range boundaries {
+		if !t.Equal(t.Truncate(time.Hour)) {
+			return false
+		}
+	}
+	return true
+}
+
+// isu_condition_hourlyを使ってグラフのデータ点を生成する
+// まだflushされていないものがあるデータ点と、集計し直せていない時間を含むデータ点はisu_conditionとバッファから計算する
+func generateIsuGraphResponseFromHourly(tx *sqlx.DB, jiaIsuUUID string, boundaries []time.Time, model *scoringModel) ([]GraphResponse, error) {
+	graphDate, endTime := boundaries[0], boundaries[len(boundaries)-1]
+
+	hourly := []IsuConditionHourly{}
+	if err := tx.Select(&hourly, "SELECT * FROM `isu_condition_hourly` WHERE `jia_isu_uuid` = ? AND `hour` >= ? AND `hour` < ? ORDER BY `hour` ASC", jiaIsuUUID, graphDate, endTime); err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	// PRIMARY KEYだけで読めるが、長い期間では集計を使う意味が無くなるので読まない
+	withTimestamps := endTime.Sub(graphDate) <= graphRollupTimestampsMaxRange
+	timestamps := []time.Time{}
+	if withTimestamps {
+		if err := tx.Select(&timestamps, "SELECT `timestamp` FROM `isu_condition` WHERE `jia_isu_uuid` = ? AND `timestamp` >= ? AND `timestamp` < ? ORDER BY `timestamp` ASC", jiaIsuUUID, graphDate, endTime); err != nil {
+			return nil, fmt.Errorf("db error: %v", err)
+		}
+	}
+	pending := pendingIsuConditionsBetween(jiaIsuUUID, graphDate, endTime)
+	dirtyHours := omIsuConditionHourlyDirty.Hours(jiaIsuUUID)
+
+	responseList := make([]GraphResponse, 0, len(boundaries)-1)
+	hourlyIndex, timestampIndex := 0, 0
+	for i := 0; i+1 < len(boundaries); i++ {
+		thisTime, nextTime := boundaries[i], boundaries[i+1]
+
+		sum := IsuConditionHourly{}
+		for ; hourlyIndex < len(hourly) && hourly[hourlyIndex].Hour.Before(nextTime); hourlyIndex++ {
+			v := hourly[hourlyIndex]
+			sum.ConditionCount += v.ConditionCount
+			sum.SittingCount += v.SittingCount
+			sum.IsDirtyCount += v.IsDirtyCount
+			sum.IsOverweightCount += v.IsOverweightCount
+			sum.IsBrokenCount += v.IsBrokenCount
+			sum.RawScoreSum += v.RawScoreSum
+		}
+		bucketTimestamps := []int64{}
+		for ; timestampIndex < len(timestamps) && timestamps[timestampIndex].Before(nextTime); timestampIndex++ {
+			bucketTimestamps = append(bucketTimestamps, timestamps[timestampIndex].Unix())
+		}
+
+		resp := GraphResponse{
+			StartAt:             thisTime.Unix(),
+			EndAt:               nextTime.Unix(),
+			ConditionTimestamps: bucketTimestamps,
+			ConditionCount:      sum.ConditionCount,
+			Source:              graphSourceRollup,
+		}
+		if hasPendingIsuConditionBetween(pending, thisTime, nextTime) || hasTimeBetween(dirtyHours, thisTime, nextTime) {
+			data, timestamps, err := calculateRawGraphBucket(tx, jiaIsuUUID, thisTime, nextTime, model)
+			if err != nil {
+				return nil, err
+			}
+			resp.Data, resp.ConditionCount, resp.Source = data, len(timestamps), graphSourceRaw
+			if withTimestamps {
+				resp.ConditionTimestamps = timestamps
+			}
+		} else if sum.ConditionCount > 0 {
+			data := graphDataPointFromHourly(sum, model)
+			resp.Data = &data
+		}
+		responseList = append(responseList, resp)
+	}
+	return responseList, nil
+}
+
+// isu_conditionの行を全て読むことになる期間が長すぎないか
+// 集計を使えない区切りや、statsを付ける場合が当てはまる
+// 集計を作り直している間だけ長すぎる場合はerrIsuConditionHourlyNotReadyを返す
+func checkGraphRawRange(boundaries []time.Time, model *scoringModel, withStats bool) error {
+	if !withStats && canUseIsuConditionHourly(boundaries, model) {
+		return nil
+	}
+	if graphMaxRawRange > 0 && boundaries[len(boundaries)-1].Sub(boundaries[0]) > graphMaxRawRange {
+		if !withStats && isuConditionHourlyCompatible(boundaries, model) {
+			return errIsuConditionHourlyNotReady
+		}
+		return fmt.Errorf("range too long without hourly aggregation: max %d days", int(graphMaxRawRange/(24*time.Hour)))
+	}
+	return nil
+}
+
+func hasPendingIsuConditionBetween(pending []*IsuCondition, start, end time.Time) bool {
+	for _, cond := range pending {
+		if !cond.Timestamp.Before(start) && cond.Timestamp.Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGraphRawRangeのエラーを返す。集計を作り直している間は後でやり直してもらう
+func graphRawRangeErrorResponse(c echo.Context, err error) error {
+	if errors.Is(err, errIsuConditionHourlyNotReady) {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(graphRollupNotReadyRetryAfter))
+		return c.String(http.StatusServiceUnavailable, err.Error())
+	}
+	return c.String(http.StatusBadRequest, err.Error())
+}
+
+func hasTimeBetween(v []time.Time, start, end time.Time) bool {
+	for _, t := range v {
+		if !t.Before(start) && t.Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+// [start, end)のデータ点をisu_conditionの行とバッファから計算する
+func calculateRawGraphBucket(tx *sqlx.DB, jiaIsuUUID string, start, end time.Time, model *scoringModel) (*GraphDataPoint, []int64, error) {
+	conditions := []IsuCondition{}
+	if err := tx.Select(&conditions, "SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? AND `timestamp` >= ? AND `timestamp` < ? ORDER BY `timestamp` ASC", jiaIsuUUID, start, end); err != nil {
+		return nil, nil, fmt.Errorf("db error: %v", err)
+	}
+	pending := pendingIsuConditionsBetween(jiaIsuUUID, start, end)
+	conditions = mergePendingIsuConditions(conditions, pending, false)
+
+	timestamps := make([]int64, 0, len(conditions))
+	for _, cond := range conditions {
+		timestamps = append(timestamps, cond.Timestamp.Unix())
+	}
+	if len(conditions) == 0 {
+		return nil, timestamps, nil
+	}
+	data, err := calculateGraphDataPoint(conditions, model, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &data, timestamps, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// GET /api/isu/:jia_isu_uuid/graph?stats=true で返すデータ点毎の詳しい統計
+// スコアはコンディション毎のスコアをmax_scoreを100として表したもの
+type GraphBucketStats struct {
+	ConditionCount   int                     `json:"condition_count"`
+	Score            float64                 `json:"score"`
+	MinScore         float64                 `json:"min_score"`
+	MaxScore         float64                 `json:"max_score"`
+	MedianScore      float64                 `json:"median_score"`
+	Percentage       ConditionsPercentageF64 `json:"percentage"`
+	LevelCounts      map[string]int          `json:"level_counts"`
+	LongestBadStreak int                     `json:"longest_bad_streak"` // 一番良いlevel以外が続いた最長のコンディション数
+	FirstTimestamp   int64                   `json:"first_timestamp"`
+	LastTimestamp    int64                   `json:"last_timestamp"`
+}
+
+type ConditionsPercentageF64 struct {
+	Sitting      float64 `json:"sitting"`
+	IsBroken     float64 `json:"is_broken"`
+	IsDirty      float64 `json:"is_dirty"`
+	IsOverweight float64 `json:"is_overweight"`
+}
+
+// calculateGraphDataPointのループの中で1件ずつ積み上げる
+type graphBucketStatsBuilder struct {
+	model  *scoringModel
+	scores []float64
+	levels []int
+	streak int
+	stats  GraphBucketStats
+}
+
+func newGraphBucketStatsBuilder(model *scoringModel, size int) *graphBucketStatsBuilder {
+	return &graphBucketStatsBuilder{
+		model:  model,
+		scores: make([]float64, 0, size),
+		levels: make([]int, len(model.Levels)),
+	}
+}
+
+// conditionsは時刻順に渡す
+func (b *graphBucketStatsBuilder) add(condition IsuCondition, level int) {
+	b.scores = append(b.scores, float64(b.model.Levels[level].Score)*100/float64(b.model.MaxScore))
+	b.levels[level]++
+
+	if level > 0 {
+		b.streak++
+		if b.streak > b.stats.LongestBadStreak {
+			b.stats.LongestBadStreak = b.streak
+		}
+	} else {
+		b.streak = 0
+	}
+
+	ts := condition.Timestamp.Unix()
+	if b.stats.ConditionCount == 0 {
+		b.stats.FirstTimestamp = ts
+	}
+	b.stats.LastTimestamp = ts
+	b.stats.ConditionCount++
+}
+
+// rawScoreとtotalWeightはGraphDataPoint.Scoreの計算に使ったもの
+func (b *graphBucketStatsBuilder) build(rawScore, totalWeight, sittingCount int, conditionsCount map[string]int) *GraphBucketStats {
+	stats := b.stats
+	n := float64(stats.ConditionCount)
+	if totalWeight > 0 {
+		stats.Score = float64(rawScore) * 100 / float64(b.model.MaxScore) / float64(totalWeight)
+	}
+
+	sort.Float64s(b.scores)
+	if len(b.scores) > 0 {
+		stats.MinScore = b.scores[0]
+		stats.MaxScore = b.scores[len(b.scores)-1]
+		mid := len(b.scores) / 2
+		if len(b.scores)%2 == 1 {
+			stats.MedianScore = b.scores[mid]
+		} else {
+			stats.MedianScore = (b.scores[mid-1] + b.scores[mid]) / 2
+		}
+	}
+
+	stats.Percentage = ConditionsPercentageF64{
+		Sitting:      float64(sittingCount) * 100 / n,
+		IsBroken:     float64(conditionsCount["is_broken"]) * 100 / n,
+		IsDirty:      float64(conditionsCount["is_dirty"]) * 100 / n,
+		IsOverweight: float64(conditionsCount["is_overweight"]) * 100 / n,
+	}
+
+	stats.LevelCounts = make(map[string]int, len(b.model.Levels))
+	for i, level := range b.model.Levels {
+		stats.LevelCounts[level.Name] += b.levels[i]
+	}
+	return &stats
+}
+
+// statsクエリパラメータ。省略した場合は付けない
+func parseGraphStatsParam(v string) (bool, error) {
+	if v == "" {
+		return false, nil
+	}
+	withStats, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("bad format: stats")
+	}
+	return withStats, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 持ち主が自分のISUを他のユーザーと共有するためのグループ
+type IsuGroup struct {
+	ID        int64     `db:"id"`
+	Name      string    `db:"name"`
+	JIAUserID string    `db:"jia_user_id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type PostIsuGroupRequest struct {
+	Name        string   `json:"name"`
+	JIAIsuUUIDs []string `json:"jia_isu_uuids"`
+	Members     []string `json:"members"`
+}
+
+type GetIsuGroupResponse struct {
+	ID          int64    `json:"id"`
+	Name        string   `json:"name"`
+	Owner       string   `json:"owner"`
+	JIAIsuUUIDs []string `json:"jia_isu_uuids"`
+	Members     []string `json:"members"`
+}
+
+// POST /api/isu_group
+// 自分のISUをまとめたグループを作り、membersに共有する
+func postIsuGroup(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	req := PostIsuGroupRequest{}
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	if req.Name == "" {
+		return c.String(http.StatusBadRequest, "missing: name")
+	}
+	req.JIAIsuUUIDs = uniqueStrings(req.JIAIsuUUIDs)
+	req.Members = uniqueStrings(req.Members)
+	for _, jiaIsuUUID := range req.JIAIsuUUIDs {
+		if _, ok := omIsu.Get(jiaIsuUUID, jiaUserID); !ok {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO `isu_group` (`name`, `jia_user_id`) VALUES (?, ?)", req.Name, jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	groupID, err := result.LastInsertId()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	for _, jiaIsuUUID := range req.JIAIsuUUIDs {
+		if _, err := tx.Exec("INSERT INTO `isu_group_isu` (`group_id`, `jia_isu_uuid`) VALUES (?, ?)", groupID, jiaIsuUUID); err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	for _, member := range req.Members {
+		if member == jiaUserID {
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO `isu_group_member` (`group_id`, `jia_user_id`) VALUES (?, ?)", groupID, member); err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res, err := getIsuGroupResponse(db, groupID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusCreated, res)
+}
+
+// GET /api/isu_group
+// 自分が作ったか共有されているグループの一覧
+func getIsuGroupList(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	groupIDs := []int64{}
+	err = db.Select(&groupIDs,
+		"SELECT `id` FROM `isu_group` WHERE `jia_user_id` = ?"+
+			" UNION SELECT `group_id` FROM `isu_group_member` WHERE `jia_user_id` = ? ORDER BY `id`",
+		jiaUserID, jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := make([]GetIsuGroupResponse, 0, len(groupIDs))
+	for _, groupID := range groupIDs {
+		group, err := getIsuGroupResponse(db, groupID)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		res = append(res, group)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func getIsuGroupResponse(tx *sqlx.DB, groupID int64) (GetIsuGroupResponse, error) {
+	group := IsuGroup{}
+	if err := tx.Get(&group, "SELECT * FROM `isu_group` WHERE `id` = ?", groupID); err != nil {
+		return GetIsuGroupResponse{}, err
+	}
+	res := GetIsuGroupResponse{ID: group.ID, Name: group.Name, Owner: group.JIAUserID, JIAIsuUUIDs: []string{}, Members: []string{}}
+	if err := tx.Select(&res.JIAIsuUUIDs, "SELECT `jia_isu_uuid` FROM `isu_group_isu` WHERE `group_id` = ? ORDER BY `jia_isu_uuid`", groupID); err != nil {
+		return GetIsuGroupResponse{}, err
+	}
+	if err := tx.Select(&res.Members, "SELECT `jia_user_id` FROM `isu_group_member` WHERE `group_id` = ? ORDER BY `jia_user_id`", groupID); err != nil {
+		return GetIsuGroupResponse{}, err
+	}
+	return res, nil
+}
+
+// グループのISU。jiaUserIDが持ち主でもメンバーでもない場合はfalse
+func isuGroupIsuUUIDs(groupID int64, jiaUserID string) ([]string, bool, error) {
+	var visible int
+	err := db.Get(&visible,
+		"SELECT 1 FROM `isu_group` WHERE `id` = ? AND (`jia_user_id` = ?"+
+			" OR EXISTS (SELECT 1 FROM `isu_group_member` WHERE `group_id` = `isu_group`.`id` AND `jia_user_id` = ?))",
+		groupID, jiaUserID, jiaUserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	jiaIsuUUIDs := []string{}
+	if err := db.Select(&jiaIsuUUIDs, "SELECT `jia_isu_uuid` FROM `isu_group_isu` WHERE `group_id` = ? ORDER BY `jia_isu_uuid`", groupID); err != nil {
+		return nil, false, err
+	}
+	return jiaIsuUUIDs, true, nil
+}
+
+// jiaUserIDが見られるISUを返す。自分のISUか、自分が持ち主かメンバーのグループに入っているISU
+func visibleIsuList(jiaUserID string, jiaIsuUUIDs []string) ([]*Isu, bool, error) {
+	shared := []string{}
+	for _, jiaIsuUUID := range jiaIsuUUIDs {
+		if _, ok := omIsu.Get(jiaIsuUUID, jiaUserID); !ok {
+			shared = append(shared, jiaIsuUUID)
+		}
+	}
+	if len(shared) > 0 {
+		query, params, err := sqlx.In(
+			"SELECT DISTINCT `gi`.`jia_isu_uuid` FROM `isu_group_isu` `gi` JOIN `isu_group` `g` ON `g`.`id` = `gi`.`group_id`"+
+				" WHERE `gi`.`jia_isu_uuid` IN (?) AND (`g`.`jia_user_id` = ?"+
+				" OR EXISTS (SELECT 1 FROM `isu_group_member` `m` WHERE `m`.`group_id` = `g`.`id` AND `m`.`jia_user_id` = ?))",
+			shared, jiaUserID, jiaUserID)
+		if err != nil {
+			return nil, false, err
+		}
+		visible := []string{}
+		if err := db.Select(&visible, db.Rebind(query), params...); err != nil {
+			return nil, false, err
+		}
+		if len(visible) != len(shared) {
+			return nil, false, nil
+		}
+	}
+
+	isuList := make([]*Isu, 0, len(jiaIsuUUIDs))
+	for _, jiaIsuUUID := range jiaIsuUUIDs {
+		isu, ok := omIsu2.Get(jiaIsuUUID)
+		if !ok {
+			return nil, false, nil
+		}
+		isuList = append(isuList, isu)
+	}
+	return isuList, true, nil
+}
+
+func uniqueStrings(v []string) []string {
+	seen := map[string]struct{}{}
+	res := make([]string, 0, len(v))
+	for _, s := range v {
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		res = append(res, s)
+	}
+	return res
+}
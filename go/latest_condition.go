@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 優先レーンとシャード毎のflushが同じISUを同時に更新して、同じコンディションを2回知らせないようにする
+var latestIsuConditionM sync.Mutex
+
+// 保存されている行より新しい場合だけ更新する
+// MySQLは左から順に代入するので`timestamp`は最後に更新する
+var latestIsuConditionUpsertStatement = bulkInsertStatement{
+	Head: "INSERT INTO `latest_isu_condition` (`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `level`) VALUES",
+	Tail: "ON DUPLICATE KEY UPDATE" +
+		" `is_sitting` = IF(VALUES(`timestamp`) >= `timestamp`, VALUES(`is_sitting`), `is_sitting`)," +
+		" `condition` = IF(VALUES(`timestamp`) >= `timestamp`, VALUES(`condition`), `condition`)," +
+		" `message` = IF(VALUES(`timestamp`) >= `timestamp`, VALUES(`message`), `message`)," +
+		" `level` = IF(VALUES(`timestamp`) >= `timestamp`, VALUES(`level`), `level`)," +
+		" `timestamp` = GREATEST(VALUES(`timestamp`), `timestamp`)",
+	Columns: 6,
+}
+
+// isu_conditionから計算し直すときは保存されている行に関わらず上書きする
+var latestIsuConditionOverwriteStatement = bulkInsertStatement{
+	Head:    "INSERT INTO `latest_isu_condition` (`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `level`) VALUES",
+	Tail:    "ON DUPLICATE KEY UPDATE `timestamp`=VALUES(`timestamp`), `is_sitting`=VALUES(`is_sitting`), `condition`=VALUES(`condition`), `message`=VALUES(`message`), `level`=VALUES(`level`)",
+	Columns: 6,
+}
+
+func latestIsuConditionRows(isuConditions []*IsuCondition) [][]interface{} {
+	rows := make([][]interface{}, 0, len(isuConditions))
+	for _, v := range isuConditions {
+		rows = append(rows, []interface{}{v.JIAIsuUUID, v.Timestamp, v.IsSitting, v.Condition, v.Message, v.Level})
+	}
+	return rows
+}
+
+// ISU毎にtimestampが最大のものだけを残す。同じtimestampなら後ろにあるものを優先する
+func latestIsuConditionsOf(isuConditions []*IsuCondition) []*IsuCondition {
+	latest := map[string]int{}
+	res := make([]*IsuCondition, 0, len(isuConditions))
+	for _, v := range isuConditions {
+		i, ok := latest[v.JIAIsuUUID]
+		if !ok {
+			latest[v.JIAIsuUUID] = len(res)
+			res = append(res, v)
+			continue
+		}
+		if !v.Timestamp.Before(res[i].Timestamp) {
+			res[i] = v
+		}
+	}
+	return res
+}
+
+// 保存されている行を実際に変えるもの。遅れて届いたものや、優先レーンで既に反映したものは除く
+func advancingLatestIsuConditions(latest []*IsuCondition) ([]*IsuCondition, error) {
+	if len(latest) == 0 {
+		return latest, nil
+	}
+	jiaIsuUUIDs := make([]string, 0, len(latest))
+	for _, v := range latest {
+		jiaIsuUUIDs = append(jiaIsuUUIDs, v.JIAIsuUUID)
+	}
+	query, params, err := sqlx.In("SELECT * FROM `latest_isu_condition` WHERE `jia_isu_uuid` IN (?)", jiaIsuUUIDs)
+	if err != nil {
+		return nil, err
+	}
+	stored := []IsuCondition{}
+	if err := db.Select(&stored, db.Rebind(query), params...); err != nil {
+		return nil, err
+	}
+	storedByUUID := make(map[string]IsuCondition, len(stored))
+	for _, v := range stored {
+		storedByUUID[v.JIAIsuUUID] = v
+	}
+
+	res := make([]*IsuCondition, 0, len(latest))
+	for _, v := range latest {
+		s, ok := storedByUUID[v.JIAIsuUUID]
+		switch {
+		case !ok, v.Timestamp.After(s.Timestamp):
+		case conditionDuplicatePolicy == conditionDuplicatePolicyUpsert && v.Timestamp.Equal(s.Timestamp) &&
+			(v.IsSitting != s.IsSitting || v.Condition != s.Condition || v.Message != s.Message || v.Level != s.Level):
+			// 重複ポリシーがupsertで同じtimestampが上書きされた。ignoreではisu_conditionに書かれないので反映しない
+		default:
+			continue
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+// latest_isu_conditionを更新し、実際に更新したものを購読者に知らせる
+func upsertLatestIsuConditions(isuConditions []*IsuCondition) ([]*IsuCondition, error) {
+	latestIsuConditionM.Lock()
+	defer latestIsuConditionM.Unlock()
+	latest, err := advancingLatestIsuConditions(latestIsuConditionsOf(isuConditions))
+	if err != nil {
+		return nil, err
+	}
+	if err := firstBulkInsertError(execBulkInsert(db, latestIsuConditionUpsertStatement, latestIsuConditionRows(latest))); err != nil {
+		return nil, err
+	}
+	conditionHub.Publish(latest)
+	return latest, nil
+}
+
+func bulkInsertLatestIsuLevels(isuConditions []*IsuCondition) {
+	// チャンク毎の失敗はexecBulkInsertがログに出す
+	if _, err := upsertLatestIsuConditions(isuConditions); err != nil {
+		log.Printf("failed to update latest_isu_condition: %v", err)
+	}
+}
+
+// latest_isu_conditionをisu_conditionの内容から作り直す
+func rebuildLatestIsuConditions() error {
+	isuConditions := []*IsuCondition{}
+	if err := db2.Select(&isuConditions, "SELECT a.* FROM `isu_condition` a JOIN (SELECT `jia_isu_uuid`, MAX(`timestamp`) AS `timestamp` FROM `isu_condition` GROUP BY `jia_isu_uuid`) b ON a.`jia_isu_uuid` = b.`jia_isu_uuid` AND a.`timestamp` = b.`timestamp`"); err != nil {
+		return err
+	}
+	chunks := execBulkInsert(db, latestIsuConditionOverwriteStatement, latestIsuConditionRows(isuConditions))
+	if err := firstBulkInsertError(chunks); err != nil {
+		return err
+	}
+	log.Printf("rebuilt latest_isu_condition for %d isu", len(isuConditions))
+	return nil
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"database/sql"
 	"errors"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -12,10 +14,12 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/goccy/go-json"
@@ -32,27 +36,6 @@ import (
 
 var group singleflight.Group
 
-type omIsuConditionListT struct {
-	M sync.Mutex
-	V []*IsuCondition
-}
-
-var omIsuConditionList omIsuConditionListT
-
-func (o *omIsuConditionListT) Get() []*IsuCondition {
-	o.M.Lock()
-	v := o.V
-	o.V = []*IsuCondition{}
-	defer o.M.Unlock()
-	return v
-}
-
-func (o *omIsuConditionListT) Set(v []*IsuCondition) {
-	o.M.Lock()
-	o.V = append(o.V, v...)
-	o.M.Unlock()
-}
-
 type omIsuT struct {
 	M sync.RWMutex
 	V map[string]*Isu
@@ -100,6 +83,7 @@ const (
 	jiaJWTSigningKeyPath        = "../ec256-public.pem"
 	defaultIconFilePath         = "../NoImage.jpg"
 	defaultJIAServiceURL        = "http://localhost:5000"
+	defaultConditionJournalDir  = "../tmp/condition_journal"
 	mysqlErrNumDuplicateEntry   = 1062
 	conditionLevelInfo          = "info"
 	conditionLevelWarning       = "warning"
@@ -109,6 +93,17 @@ const (
 	scoreConditionLevelCritical = 1
 )
 
+const (
+	defaultShutdownTimeoutSec      = 10
+	defaultShutdownFlushTimeoutSec = 10
+
+	// /debug/varsと/admin以下はループバックのこのアドレスだけで受ける
+	defaultAdminAddr = "127.0.0.1:3001"
+
+	defaultConditionBufferMaxEntries = 200000
+	defaultConditionBufferMaxBytes   = 64 << 20
+)
+
 var (
 	db                  *sqlx.DB
 	db2                 *sqlx.DB
@@ -118,6 +113,8 @@ var (
 	jiaJWTSigningKey *ecdsa.PublicKey
 
 	postIsuConditionTargetBaseURL string // JIAへのactivate時に登録する，ISUがconditionを送る先のURL
+
+	conditionBufferRetryAfter int // バッファが溢れたときにISUへ返すRetry-After(秒)
 )
 
 type LatestIsuCondition struct {
@@ -196,12 +193,16 @@ type GraphResponse struct {
 	StartAt             int64           `json:"start_at"`
 	EndAt               int64           `json:"end_at"`
 	Data                *GraphDataPoint `json:"data"`
-	ConditionTimestamps []int64         `json:"condition_timestamps"`
+	ConditionTimestamps []int64         `json:"condition_timestamps"` // 集計から返す長い期間では空
+	ConditionCount      int             `json:"condition_count"`
+	Source              string          `json:"source"` // データ点を何から計算したか
 }
 
 type GraphDataPoint struct {
-	Score      int                  `json:"score"`
-	Percentage ConditionsPercentage `json:"percentage"`
+	Score        int                  `json:"score"`
+	Percentage   ConditionsPercentage `json:"percentage"`
+	ScoringModel string               `json:"scoring_model"`
+	Stats        *GraphBucketStats    `json:"stats,omitempty"`
 }
 
 type ConditionsPercentage struct {
@@ -211,13 +212,6 @@ type ConditionsPercentage struct {
 	IsOverweight int `json:"is_overweight"`
 }
 
-type GraphDataPointWithInfo struct {
-	JIAIsuUUID          string
-	StartAt             time.Time
-	Data                GraphDataPoint
-	ConditionTimestamps []int64
-}
-
 type GetIsuConditionResponse struct {
 	JIAIsuUUID     string `json:"jia_isu_uuid"`
 	IsuName        string `json:"isu_name"`
@@ -250,6 +244,7 @@ type PostIsuConditionRequest struct {
 type JIAServiceRequest struct {
 	TargetBaseURL string `json:"target_base_url"`
 	IsuUUID       string `json:"isu_uuid"`
+	DeviceSecret  string `json:"device_secret"` // ISUがconditionを送るときの認証に使う
 }
 
 func getEnv(key string, defaultValue string) string {
@@ -260,6 +255,19 @@ func getEnv(key string, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		log.Printf("invalid %s: %v", key, err)
+		return defaultValue
+	}
+	return i
+}
+
 func NewMySQLConnectionEnv() *MySQLConnectionEnv {
 	return &MySQLConnectionEnv{
 		Host:     getEnv("MYSQL_HOST", "127.0.0.1"),
@@ -272,13 +280,13 @@ func NewMySQLConnectionEnv() *MySQLConnectionEnv {
 }
 
 func (mc *MySQLConnectionEnv) ConnectDB() (*sqlx.DB, *sqlx.DB, error) {
-	dsn2 := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?parseTime=true&loc=Asia%%2FTokyo&interpolateParams=true", mc.User, mc.Password, mc.Host, mc.Port, mc.DBName)
+	dsn2 := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?parseTime=true&loc=UTC&time_zone=%%27%%2B00%%3A00%%27&interpolateParams=true", mc.User, mc.Password, mc.Host, mc.Port, mc.DBName)
 	isu2, err := sqlx.Open("mysql", dsn2)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	dsn3 := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?parseTime=true&loc=Asia%%2FTokyo&interpolateParams=true", mc.User, mc.Password, mc.Host2, mc.Port, mc.DBName)
+	dsn3 := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?parseTime=true&loc=UTC&time_zone=%%27%%2B00%%3A00%%27&interpolateParams=true", mc.User, mc.Password, mc.Host2, mc.Port, mc.DBName)
 	isu3, err := sqlx.Open("mysql", dsn3)
 	if err != nil {
 		return nil, nil, err
@@ -318,6 +326,10 @@ func (j *JSONSerializer) Deserialize(c echo.Context, i interface{}) error {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	var err error
 	e := echo.New()
 	e.JSONSerializer = &JSONSerializer{}
@@ -341,15 +353,36 @@ func main() {
 	e.POST("/api/auth", postAuthentication)
 	e.POST("/api/signout", postSignout)
 	e.GET("/api/user/me", getMe)
+	e.POST("/api/user/me/timezone", postUserTimezone)
 	e.GET("/api/isu", getIsuList)
 	e.POST("/api/isu", postIsu)
 	e.GET("/api/isu/:jia_isu_uuid", getIsuID)
 	e.GET("/api/isu/:jia_isu_uuid/icon", getIsuIcon)
 	e.GET("/api/isu/:jia_isu_uuid/graph", getIsuGraph)
+	e.GET("/api/compare/graph", getIsuCompareGraph)
+	e.GET("/api/isu_group", getIsuGroupList)
+	e.POST("/api/isu_group", postIsuGroup)
+	e.POST("/api/isu/:jia_isu_uuid/device_credential", postIsuDeviceCredential)
 	e.GET("/api/condition/:jia_isu_uuid", getIsuConditions)
 	e.GET("/api/trend", getTrend)
+	e.GET("/api/latest_condition/stream", getLatestConditionStream)
 
 	e.POST("/api/condition/:jia_isu_uuid", postIsuCondition)
+	e.POST("/api/condition/:jia_isu_uuid/stream", postIsuConditionStream)
+	e.GET("/api/condition/:jia_isu_uuid/stream", getIsuConditionStream)
+
+	// 認証が無いので、SERVER_APP_PORTとは別にループバックでだけ受ける
+	admin := echo.New()
+	admin.HideBanner = true
+	admin.JSONSerializer = &JSONSerializer{}
+	admin.Logger.SetLevel(gommonLog.ERROR)
+	admin.Logger.SetOutput(logfile)
+	admin.Use(middleware.Recover())
+	admin.GET("/debug/vars", echo.WrapHandler(expvar.Handler()))
+	admin.GET("/admin/condition/dead_letter", getConditionDeadLetter)
+	admin.POST("/admin/condition/dead_letter/redrive", postConditionDeadLetterRedrive)
+	admin.GET("/admin/scoring_model", getScoringModel)
+	admin.POST("/admin/scoring_model/reload", postScoringModelReload)
 
 	e.GET("/", getIndex)
 	e.GET("/isu/:jia_isu_uuid", getIndex)
@@ -388,8 +421,102 @@ func main() {
 		return
 	}
 
-	omIsuConditionList.V = []*IsuCondition{}
-	go loopPostIsuCondition()
+	omIsuConditionList.MaxEntries = getEnvInt("CONDITION_BUFFER_MAX_ENTRIES", defaultConditionBufferMaxEntries)
+	omIsuConditionList.MaxBytes = getEnvInt("CONDITION_BUFFER_MAX_BYTES", defaultConditionBufferMaxBytes)
+	conditionBufferRetryAfter = getEnvInt("CONDITION_BUFFER_RETRY_AFTER", 1)
+	loadBulkInsertConfig()
+	conditionDuplicatePolicy = getEnv("CONDITION_DUPLICATE_POLICY", conditionDuplicatePolicyIgnore)
+	switch conditionDuplicatePolicy {
+	case conditionDuplicatePolicyIgnore:
+		isuConditionInsertStatement.Tail = "ON DUPLICATE KEY UPDATE `jia_isu_uuid` = `jia_isu_uuid`"
+	case conditionDuplicatePolicyUpsert:
+		isuConditionInsertStatement.Tail = "ON DUPLICATE KEY UPDATE `is_sitting`=VALUES(`is_sitting`), `condition`=VALUES(`condition`), `message`=VALUES(`message`), `level`=VALUES(`level`)"
+	default:
+		e.Logger.Fatalf("invalid CONDITION_DUPLICATE_POLICY: %s", conditionDuplicatePolicy)
+		return
+	}
+	if err := loadConditionRateLimitConfig(); err != nil {
+		e.Logger.Fatalf("failed to load condition rate limit: %v", err)
+		return
+	}
+	if err := loadDeviceAuthConfig(); err != nil {
+		e.Logger.Fatalf("failed to load device auth config: %v", err)
+		return
+	}
+	if err := loadConditionTimestampWindow(); err != nil {
+		e.Logger.Fatalf("failed to load condition timestamp window: %v", err)
+		return
+	}
+	loadConditionCompressionConfig()
+	if err := loadTimezoneConfig(); err != nil {
+		e.Logger.Fatalf("failed to load DEFAULT_TIMEZONE: %v", err)
+		return
+	}
+	graphMaxBuckets = getEnvInt("GRAPH_MAX_BUCKETS", defaultGraphMaxBuckets)
+	graphMaxRange = time.Duration(getEnvInt("GRAPH_MAX_RANGE_DAYS", defaultGraphMaxRangeDays)) * 24 * time.Hour
+	graphMaxRawRange = time.Duration(getEnvInt("GRAPH_MAX_RAW_RANGE_DAYS", defaultGraphMaxRawRangeDays)) * 24 * time.Hour
+	graphRollupTimestampsMaxRange = time.Duration(getEnvInt("GRAPH_ROLLUP_TIMESTAMPS_MAX_HOURS", defaultGraphRollupTimestampsMaxHours)) * time.Hour
+	loadGraphCompareConfig()
+	if err := loadScoringModelConfig(); err != nil {
+		e.Logger.Fatalf("failed to load scoring model: %v", err)
+		return
+	}
+	if err := loadConditionShedConfig(); err != nil {
+		e.Logger.Fatalf("failed to load condition shed config: %v", err)
+		return
+	}
+	conditionStreamAckItems = getEnvInt("CONDITION_STREAM_ACK_ITEMS", defaultConditionStreamAckItems)
+	conditionStreamAckInterval = time.Duration(getEnvInt("CONDITION_STREAM_ACK_INTERVAL_MS", defaultConditionStreamAckIntervalMS)) * time.Millisecond
+	if conditionStreamAckInterval <= 0 {
+		e.Logger.Fatalf("CONDITION_STREAM_ACK_INTERVAL_MS must be positive")
+		return
+	}
+	conditionFlushRetry = getEnvInt("CONDITION_FLUSH_RETRY", defaultConditionFlushRetry)
+	conditionFlushBackoff = time.Duration(getEnvInt("CONDITION_FLUSH_BACKOFF_MS", defaultConditionFlushBackoffMS)) * time.Millisecond
+	conditionFlushMaxFailures = getEnvInt("CONDITION_FLUSH_MAX_FAILURES", defaultConditionFlushMaxFailures)
+	conditionDeadLetter.File = getEnv("CONDITION_DEAD_LETTER_FILE", defaultConditionDeadLetterFile)
+	if err := conditionDeadLetter.ReplayFile(); err != nil {
+		// ファイルは残っているので次の起動かredriveでやり直す
+		log.Printf("failed to replay dead letter file: %v", err)
+	}
+	journalDir := getEnv("CONDITION_JOURNAL_DIR", defaultConditionJournalDir)
+	journalSegments, err := listConditionJournalSegments(journalDir)
+	if err != nil {
+		e.Logger.Fatalf("failed to open condition journal: %v", err)
+		return
+	}
+	conditionFlushInterval := time.Duration(getEnvInt("CONDITION_FLUSH_INTERVAL_MS", defaultConditionFlushIntervalMS)) * time.Millisecond
+	if conditionFlushInterval <= 0 {
+		e.Logger.Fatalf("CONDITION_FLUSH_INTERVAL_MS must be positive")
+		return
+	}
+	err = omIsuConditionList.Init(
+		getEnvInt("CONDITION_SHARDS", defaultConditionShards),
+		journalDir,
+		getEnv("CONDITION_JOURNAL_SYNC", "0") == "1",
+		conditionFlushInterval,
+		getEnvInt("CONDITION_FLUSH_MAX_BATCH", defaultConditionFlushMaxBatch),
+	)
+	if err != nil {
+		e.Logger.Fatalf("failed to open condition journal: %v", err)
+		return
+	}
+	defer omIsuConditionList.Close()
+	if err := replayConditionJournal(journalSegments); err != nil {
+		e.Logger.Fatalf("failed to replay condition journal: %v", err)
+		return
+	}
+	stopFlush := make(chan struct{})
+	flushDone := make(chan struct{})
+	go loopPostIsuCondition(stopFlush, flushDone)
+	stopPriorityLane := make(chan struct{})
+	priorityLaneDone := make(chan struct{})
+	if size := getEnvInt("CONDITION_PRIORITY_LANE_SIZE", defaultConditionPriorityLaneSize); size > 0 {
+		conditionPriorityLane.Init(size)
+		go conditionPriorityLane.loop(stopPriorityLane, priorityLaneDone)
+	} else {
+		close(priorityLaneDone)
+	}
 
 	isuList := make([]*Isu, 0)
 	if err := db.Select(&isuList, "SELECT * FROM isu"); err != nil {
@@ -407,6 +534,11 @@ func main() {
 		omIsu.Set(v)
 		omIsu2.Set(v)
 	}
+	if err := omIsuCredential.Load(); err != nil {
+		log.Println(err)
+		return
+	}
+	startIsuConditionHourlyBackfill()
 
 	if os.Getenv("ISU") == "1" {
 		socketFile := "/home/isucon/webapp/tmp/app.sock"
@@ -424,11 +556,75 @@ func main() {
 		}
 
 		e.Listener = l
-		e.Logger.Fatal(e.Start(""))
-	} else {
-		serverPort := fmt.Sprintf(":%v", getEnv("SERVER_APP_PORT", "3000"))
-		e.Logger.Fatal(e.Start(serverPort))
 	}
+	adminAddr := getEnv("ADMIN_ADDR", defaultAdminAddr)
+	if !isLoopbackAddr(adminAddr) {
+		e.Logger.Fatalf("ADMIN_ADDR must be a loopback address: %s", adminAddr)
+	}
+	go func() {
+		if err := admin.Start(adminAddr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
+		}
+	}()
+	go func() {
+		address := ""
+		if e.Listener == nil {
+			address = fmt.Sprintf(":%v", getEnv("SERVER_APP_PORT", "3000"))
+		}
+		if err := e.Start(address); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
+	<-quit
+	log.Print("shutting down")
+
+	// 新しいリクエストを止めてからバッファに残ったコンディションを書き切る
+	// ストリームは止まるまで待つと期限を使い切るので、こちらから終わらせる
+	// flushにはリクエストの処理とは別に期限を設ける。期限を過ぎた分はジャーナルに残っているので次回起動時に再投入される
+	// ジャーナルとDBを閉じるdeferはflushが終わるか期限を過ぎてから実行される
+	shutdownTimeout := time.Duration(getEnvInt("SHUTDOWN_TIMEOUT_SEC", defaultShutdownTimeoutSec)) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	e.Server.RegisterOnShutdown(conditionHub.Close)
+	e.Server.RegisterOnShutdown(closeConditionStreams)
+	if err := e.Shutdown(ctx); err != nil {
+		log.Printf("failed to shutdown server: %v", err)
+	}
+	if err := admin.Shutdown(ctx); err != nil {
+		log.Printf("failed to shutdown admin server: %v", err)
+	}
+
+	flushTimeout := time.Duration(getEnvInt("SHUTDOWN_FLUSH_TIMEOUT_SEC", defaultShutdownFlushTimeoutSec)) * time.Second
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancelFlush()
+	close(stopPriorityLane)
+	select {
+	case <-priorityLaneDone:
+	case <-flushCtx.Done():
+	}
+	close(stopFlush)
+	select {
+	case <-flushDone:
+		log.Print("flushed buffered conditions")
+	case <-flushCtx.Done():
+		log.Print("shutdown deadline exceeded before flushing buffered conditions")
+	}
+}
+
+// host:portのhostがループバックか
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 func getSession(r *http.Request) (*sessions.Session, error) {
@@ -504,23 +700,14 @@ func postInitialize(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	latestIsuConditions := []IsuCondition{}
-	if err := db.Select(&latestIsuConditions, "select * from isu_condition a JOIN (select jia_isu_uuid, MAX(`timestamp`) AS `timestamp` FROM isu_condition GROUP BY jia_isu_uuid) b ON a.jia_isu_uuid = b.jia_isu_uuid WHERE a.timestamp = b.timestamp"); err != nil {
+	if err := rebuildLatestIsuConditions(); err != nil {
 		c.Logger().Errorf("db error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-
-	args := make([]interface{}, 0, len(latestIsuConditions)*6)
-	placeHolders := &strings.Builder{}
-	for i, v := range latestIsuConditions {
-		args = append(args, v.JIAIsuUUID, v.Timestamp, v.Level, v.IsSitting, v.Message, v.Condition)
-		if i == 0 {
-			placeHolders.WriteString(" (?, ?, ?, ?, ?, ?)")
-		} else {
-			placeHolders.WriteString(",(?, ?, ?, ?, ?, ?)")
-		}
-	}
-	if _, err = db.Exec("INSERT INTO latest_isu_condition (`jia_isu_uuid`, `timestamp`,`level`, `is_sitting`, `message`, `condition`) VALUES"+placeHolders.String(), args...); err != nil {
+	// 集計の作り直しは時間がかかるので待たない。終わるまでグラフはisu_conditionから計算する
+	startIsuConditionHourlyBackfill()
+	omUserTimezone.Reset()
+	if err := omIsuCredential.Load(); err != nil {
 		c.Logger().Errorf("db error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
@@ -779,8 +966,14 @@ func postIsu(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	credential, err := issueDeviceCredential(tx, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	targetURL := getJIAServiceURL(tx) + "/api/activate"
-	body := JIAServiceRequest{postIsuConditionTargetBaseURL, jiaIsuUUID}
+	body := JIAServiceRequest{postIsuConditionTargetBaseURL, jiaIsuUUID, credential.Secret}
 	bodyJSON, err := json.Marshal(body)
 	if err != nil {
 		c.Logger().Error(err)
@@ -843,6 +1036,7 @@ func postIsu(c echo.Context) error {
 		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	omIsuCredential.Set(credential)
 
 	return c.JSON(http.StatusCreated, isu)
 }
@@ -921,176 +1115,135 @@ func getIsuGraph(c echo.Context) error {
 	}
 
 	jiaIsuUUID := c.Param("jia_isu_uuid")
-	datetimeStr := c.QueryParam("datetime")
-	if datetimeStr == "" {
-		return c.String(http.StatusBadRequest, "missing: datetime")
+	loc, err := requestLocation(c, jiaUserID)
+	if err != nil {
+		if errors.Is(err, errBadTimezone) {
+			return c.String(http.StatusBadRequest, "bad format: tz")
+		}
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	boundaries, err := parseGraphRange(c.QueryParam("datetime"), c.QueryParam("start"), c.QueryParam("end"), c.QueryParam("resolution"), c.QueryParam("buckets"), loc)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	format := c.QueryParam("format")
+	if !isValidGraphFormat(format) {
+		return c.String(http.StatusBadRequest, "bad format: format")
 	}
-	datetimeInt64, err := strconv.ParseInt(datetimeStr, 10, 64)
+	withStats, err := parseGraphStatsParam(c.QueryParam("stats"))
 	if err != nil {
-		return c.String(http.StatusBadRequest, "bad format: datetime")
+		return c.String(http.StatusBadRequest, err.Error())
 	}
-	date := time.Unix(datetimeInt64, 0).Truncate(time.Hour)
 
-	_, ok := omIsu.Get(jiaIsuUUID, jiaUserID)
+	isu, ok := omIsu.Get(jiaIsuUUID, jiaUserID)
 	if !ok {
 		return c.String(http.StatusNotFound, "not found: isu")
 	}
 
-	res, err := generateIsuGraphResponse(db2, jiaIsuUUID, date)
+	model := currentScoringModel()
+	if err := checkGraphRawRange(boundaries, model, withStats); err != nil {
+		return graphRawRangeErrorResponse(c, err)
+	}
+
+	res, err := generateIsuGraphResponse(db2, jiaIsuUUID, boundaries, model, withStats)
 	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	return c.JSON(http.StatusOK, res)
+	return writeIsuGraph(c, isu, res, format, loc)
 }
 
-// グラフのデータ点を一日分生成
-func generateIsuGraphResponse(tx *sqlx.DB, jiaIsuUUID string, graphDate time.Time) ([]GraphResponse, error) {
-	dataPoints := []GraphDataPointWithInfo{}
-	conditionsInThisHour := []IsuCondition{}
-	timestampsInThisHour := []int64{}
-	var startTimeInThisHour time.Time
-	var condition IsuCondition
+// グラフのデータ点を区切り毎に生成
+// i番目のデータ点は[boundaries[i], boundaries[i+1])のコンディションから計算する
+// withStatsの場合は集計からは計算できないので常にisu_conditionの行を使う
+func generateIsuGraphResponse(tx *sqlx.DB, jiaIsuUUID string, boundaries []time.Time, model *scoringModel, withStats bool) ([]GraphResponse, error) {
+	if !withStats && canUseIsuConditionHourly(boundaries, model) {
+		return generateIsuGraphResponseFromHourly(tx, jiaIsuUUID, boundaries, model)
+	}
 
-	rows, err := tx.Queryx("SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? AND `timestamp` BETWEEN ? AND ? ORDER BY `timestamp` ASC", jiaIsuUUID, graphDate, graphDate.Add(time.Hour*24))
+	graphDate, endTime := boundaries[0], boundaries[len(boundaries)-1]
+	conditions := []IsuCondition{}
+	err := tx.Select(&conditions, "SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? AND `timestamp` >= ? AND `timestamp` < ? ORDER BY `timestamp` ASC", jiaIsuUUID, graphDate, endTime)
 	if err != nil {
 		return nil, fmt.Errorf("db error: %v", err)
 	}
+	// 受け付けてまだflushされていないものも含める
+	pending := pendingIsuConditionsBetween(jiaIsuUUID, graphDate, endTime)
+	conditions = mergePendingIsuConditions(conditions, pending, false)
 
-	for rows.Next() {
-		err = rows.StructScan(&condition)
-		if err != nil {
-			return nil, err
-		}
-
-		truncatedConditionTime := condition.Timestamp.Truncate(time.Hour)
-		if truncatedConditionTime != startTimeInThisHour {
-			if len(conditionsInThisHour) > 0 {
-				data, err := calculateGraphDataPoint(conditionsInThisHour)
-				if err != nil {
-					return nil, err
-				}
-
-				dataPoints = append(dataPoints,
-					GraphDataPointWithInfo{
-						JIAIsuUUID:          jiaIsuUUID,
-						StartAt:             startTimeInThisHour,
-						Data:                data,
-						ConditionTimestamps: timestampsInThisHour})
-			}
-
-			startTimeInThisHour = truncatedConditionTime
-			conditionsInThisHour = []IsuCondition{}
-			timestampsInThisHour = []int64{}
-		}
-		conditionsInThisHour = append(conditionsInThisHour, condition)
-		timestampsInThisHour = append(timestampsInThisHour, condition.Timestamp.Unix())
-	}
-
-	if len(conditionsInThisHour) > 0 {
-		data, err := calculateGraphDataPoint(conditionsInThisHour)
-		if err != nil {
-			return nil, err
-		}
-
-		dataPoints = append(dataPoints,
-			GraphDataPointWithInfo{
-				JIAIsuUUID:          jiaIsuUUID,
-				StartAt:             startTimeInThisHour,
-				Data:                data,
-				ConditionTimestamps: timestampsInThisHour})
-	}
-
-	endTime := graphDate.Add(time.Hour * 24)
-	startIndex := len(dataPoints)
-	endNextIndex := len(dataPoints)
-	for i, graph := range dataPoints {
-		if startIndex == len(dataPoints) && !graph.StartAt.Before(graphDate) {
-			startIndex = i
-		}
-		if endNextIndex == len(dataPoints) && graph.StartAt.After(endTime) {
-			endNextIndex = i
-		}
-	}
-
-	filteredDataPoints := []GraphDataPointWithInfo{}
-	if startIndex < endNextIndex {
-		filteredDataPoints = dataPoints[startIndex:endNextIndex]
-	}
-
-	responseList := []GraphResponse{}
+	responseList := make([]GraphResponse, 0, len(boundaries)-1)
 	index := 0
-	thisTime := graphDate
+	for i := 0; i+1 < len(boundaries); i++ {
+		thisTime, nextTime := boundaries[i], boundaries[i+1]
+		start := index
+		for index < len(conditions) && conditions[index].Timestamp.Before(nextTime) {
+			index++
+		}
+		conditionsInThisBucket := conditions[start:index]
 
-	for thisTime.Before(graphDate.Add(time.Hour * 24)) {
 		var data *GraphDataPoint
-		timestamps := []int64{}
-
-		if index < len(filteredDataPoints) {
-			dataWithInfo := filteredDataPoints[index]
-
-			if dataWithInfo.StartAt.Equal(thisTime) {
-				data = &dataWithInfo.Data
-				timestamps = dataWithInfo.ConditionTimestamps
-				index++
+		timestamps := make([]int64, 0, len(conditionsInThisBucket))
+		for _, condition := range conditionsInThisBucket {
+			timestamps = append(timestamps, condition.Timestamp.Unix())
+		}
+		if len(conditionsInThisBucket) > 0 {
+			dataPoint, err := calculateGraphDataPoint(conditionsInThisBucket, model, withStats)
+			if err != nil {
+				return nil, err
 			}
+			data = &dataPoint
 		}
 
 		resp := GraphResponse{
 			StartAt:             thisTime.Unix(),
-			EndAt:               thisTime.Add(time.Hour).Unix(),
+			EndAt:               nextTime.Unix(),
 			Data:                data,
 			ConditionTimestamps: timestamps,
+			ConditionCount:      len(timestamps),
+			Source:              graphSourceRaw,
 		}
 		responseList = append(responseList, resp)
-
-		thisTime = thisTime.Add(time.Hour)
 	}
 
 	return responseList, nil
 }
 
 // 複数のISUのコンディションからグラフの一つのデータ点を計算
-func calculateGraphDataPoint(isuConditions []IsuCondition) (GraphDataPoint, error) {
+// withStatsの場合はGraphBucketStatsも同じループで計算する
+func calculateGraphDataPoint(isuConditions []IsuCondition, model *scoringModel, withStats bool) (GraphDataPoint, error) {
 	conditionsCount := map[string]int{"is_broken": 0, "is_dirty": 0, "is_overweight": 0}
 	rawScore := 0
+	totalWeight := 0
+	sittingCount := 0
+	var stats *graphBucketStatsBuilder
+	if withStats {
+		stats = newGraphBucketStatsBuilder(model, len(isuConditions))
+	}
 	for _, condition := range isuConditions {
-		badConditionsCount := 0
-
 		if !isValidConditionFormat(condition.Condition) {
 			return GraphDataPoint{}, fmt.Errorf("invalid condition format")
 		}
 
-		for _, condStr := range strings.Split(condition.Condition, ",") {
-			keyValue := strings.Split(condStr, "=")
-
-			conditionName := keyValue[0]
-			if keyValue[1] == "true" {
-				conditionsCount[conditionName] += 1
-				badConditionsCount++
-			}
-		}
-
-		if badConditionsCount >= 3 {
-			rawScore += scoreConditionLevelCritical
-		} else if badConditionsCount >= 1 {
-			rawScore += scoreConditionLevelWarning
-		} else {
-			rawScore += scoreConditionLevelInfo
-		}
-	}
-
-	sittingCount := 0
-	for _, condition := range isuConditions {
+		level := model.level(condition.Condition, conditionsCount)
+		weight := model.weight(condition.IsSitting)
+		rawScore += model.Levels[level].Score * weight
+		totalWeight += weight
 		if condition.IsSitting {
 			sittingCount++
 		}
+		if stats != nil {
+			stats.add(condition, level)
+		}
 	}
 
 	isuConditionsLength := len(isuConditions)
 
-	score := rawScore * 100 / 3 / isuConditionsLength
+	score := 0
+	if totalWeight > 0 {
+		score = rawScore * 100 / model.MaxScore / totalWeight
+	}
 
 	sittingPercentage := sittingCount * 100 / isuConditionsLength
 	isBrokenPercentage := conditionsCount["is_broken"] * 100 / isuConditionsLength
@@ -1105,6 +1258,10 @@ func calculateGraphDataPoint(isuConditions []IsuCondition) (GraphDataPoint, erro
 			IsOverweight: isOverweightPercentage,
 			IsDirty:      isDirtyPercentage,
 		},
+		ScoringModel: model.Version,
+	}
+	if stats != nil {
+		dataPoint.Stats = stats.build(rawScore, totalWeight, sittingCount, conditionsCount)
 	}
 	return dataPoint, nil
 }
@@ -1199,6 +1356,11 @@ func getIsuConditionsFromDB(db *sqlx.DB, jiaIsuUUID string, endTime time.Time, c
 	if err := db2.Select(&conditions, db.Rebind(query), params...); err != nil {
 		return nil, fmt.Errorf("db error: %v", err)
 	}
+	// 受け付けてまだflushされていないものも返す
+	conditions = mergePendingIsuConditions(conditions, pendingIsuConditionsForList(jiaIsuUUID, endTime, conditionLevel, startTime), true)
+	if len(conditions) > limit {
+		conditions = conditions[:limit]
+	}
 
 	conditionsResponse := make([]*GetIsuConditionResponse, 0, len(conditions))
 	for _, c := range conditions {
@@ -1312,67 +1474,62 @@ func getTrend(c echo.Context) error {
 // POST /api/condition/:jia_isu_uuid
 // ISUからのコンディションを受け取る
 func postIsuCondition(c echo.Context) error {
-	// TODO: 一定割合リクエストを落としてしのぐようにしたが、本来は全量さばけるようにすべき
-	//dropProbability := 0.9
-	//if rand.Float64() <= dropProbability {
-	//	c.Logger().Warnf("drop post isu condition request")
-	//	return c.NoContent(http.StatusAccepted)
-	//}
-
 	jiaIsuUUID := c.Param("jia_isu_uuid")
 	if jiaIsuUUID == "" {
 		return c.String(http.StatusBadRequest, "missing: jia_isu_uuid")
 	}
+	// 存在しないISUのボディは展開もせず、統計にも入れない
+	isu, ok := omIsu2.Get(jiaIsuUUID)
+	if !ok {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
 
-	req := []PostIsuConditionRequest{}
-	err := c.Bind(&req)
+	// gzipとzstdで圧縮されたボディも受け付ける。署名は送られてきたままのボディで検証する
+	body, err := readConditionBody(c)
 	if err != nil {
-		return c.String(http.StatusBadRequest, "bad request body")
+		return conditionBodyErrorResponse(c, err)
+	}
+	if err := verifyDeviceRequest(c, jiaIsuUUID, true); err != nil {
+		return deviceAuthErrorResponse(c, err)
+	}
+	if err := decompressConditionBody(c, jiaIsuUUID, body); err != nil {
+		return conditionBodyErrorResponse(c, err)
+	}
+
+	// JSONの他にMessagePackとProtobufも受け付ける
+	req, err := bindPostIsuConditionRequest(c)
+	if err != nil {
+		return bindConditionErrorResponse(c, err)
 	} else if len(req) == 0 {
 		return c.String(http.StatusBadRequest, "bad request body")
 	}
 
-	_, ok := omIsu2.Get(jiaIsuUUID)
-	if !ok {
-		return c.String(http.StatusNotFound, "not found: isu")
+	rateLimitRes := conditionRateLimiter.Allow(isu, len(req))
+	setRateLimitHeaders(c, rateLimitRes)
+	if !rateLimitRes.Allowed {
+		return c.String(http.StatusTooManyRequests, "too many conditions")
 	}
 
-	isuConditions := make([]*IsuCondition, 0, len(req))
-
-	for _, cond := range req {
-		timestamp := time.Unix(cond.Timestamp, 0)
-
-		if !isValidConditionFormat(cond.Condition) {
+	// result=itemsの場合は不正なものだけを弾き、1件毎の結果を返す
+	perItem := c.QueryParam("result") == "items"
+	res, err := ingestIsuConditions(jiaIsuUUID, req, !perItem)
+	if err != nil {
+		if errors.Is(err, errConditionBufferFull) {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(conditionBufferRetryAfter))
+			return c.String(http.StatusServiceUnavailable, "condition buffer is full")
+		}
+		if errors.Is(err, errBadConditionRequest) {
 			return c.String(http.StatusBadRequest, "bad request body")
 		}
-
-		level, err := calculateConditionLevel(cond.Condition)
-		if err != nil {
-			c.Logger().Errorf("db error: %v", err)
-			return c.NoContent(http.StatusInternalServerError)
+		c.Logger().Errorf("ingest error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if perItem {
+		if len(res.Accepted) == 0 && len(res.Duplicate) == 0 && len(res.Quarantined) == 0 && len(res.Shed) == 0 {
+			return c.JSON(http.StatusBadRequest, res)
 		}
-
-		isuConditions = append(isuConditions, &IsuCondition{
-			JIAIsuUUID: jiaIsuUUID,
-			Timestamp:  timestamp,
-			IsSitting:  cond.IsSitting,
-			Condition:  cond.Condition,
-			Message:    cond.Message,
-			Level:      level,
-		})
-		//
-		//_, err = tx.Exec(
-		//	"INSERT INTO `isu_condition`"+
-		//		"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`)"+
-		//		"	VALUES (?, ?, ?, ?, ?)",
-		//	jiaIsuUUID, timestamp, cond.IsSitting, cond.Condition, cond.Message)
-		//if err != nil {
-		//	c.Logger().Errorf("db error: %v", err)
-		//	return c.NoContent(http.StatusInternalServerError)
-		//}
-	}
-
-	omIsuConditionList.Set(isuConditions)
+		return c.JSON(http.StatusAccepted, res)
+	}
 	//
 	//args := make([]interface{}, 0, len(isuConditions)*5)
 	//placeHolders := &strings.Builder{}
@@ -1393,49 +1550,6 @@ func postIsuCondition(c echo.Context) error {
 	return c.NoContent(http.StatusAccepted)
 }
 
-func loopPostIsuCondition() {
-	for range time.Tick(time.Millisecond * 100) {
-		isuConditions := omIsuConditionList.Get()
-		if len(isuConditions) == 0 {
-			continue
-		}
-		args := make([]interface{}, 0, len(isuConditions)*6)
-		placeHolders := &strings.Builder{}
-		for i, v := range isuConditions {
-			args = append(args, v.JIAIsuUUID, v.Timestamp, v.IsSitting, v.Condition, v.Message, v.Level)
-			if i == 0 {
-				placeHolders.WriteString(" (?, ?, ?, ?, ?, ?)")
-			} else {
-				placeHolders.WriteString(",(?, ?, ?, ?, ?, ?)")
-			}
-		}
-		_, err := db2.Exec("INSERT INTO `isu_condition` (`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `level`) VALUES"+placeHolders.String(), args...)
-		if err != nil {
-			log.Println(err)
-		}
-
-		bulkInsertLatestIsuLevels(isuConditions)
-	}
-}
-
-func bulkInsertLatestIsuLevels(isuConditions []*IsuCondition) {
-	latestIsuConditions := make([]LatestIsuCondition, 0, len(isuConditions))
-	for _, v := range isuConditions {
-		latestIsuConditions = append(latestIsuConditions, LatestIsuCondition{
-			JIAIsuUUID: v.JIAIsuUUID,
-			Timestamp:  v.Timestamp,
-			IsSitting:  v.IsSitting,
-			Condition:  v.Condition,
-			Message:    v.Message,
-			Level:      v.Level,
-		})
-	}
-	if _, err := db.NamedExec("INSERT INTO `latest_isu_condition` (`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `level`) VALUES (:jia_isu_uuid, :timestamp, :is_sitting, :condition, :message"+
-		", :level) ON DUPLICATE KEY UPDATE `timestamp`=VALUES(`timestamp`), `is_sitting`=VALUES(`is_sitting`), `condition`=VALUES(`condition`), `message`=VALUES(`message`), `level`=VALUES(`level`)", latestIsuConditions); err != nil {
-		log.Println(err)
-	}
-}
-
 // ISUのコンディションの文字列がcsv形式になっているか検証
 func isValidConditionFormat(conditionStr string) bool {
 
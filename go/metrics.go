@@ -0,0 +1,27 @@
+package main
+
+import "expvar"
+
+// /debug/vars で公開するメトリクス
+var (
+	conditionBufferRejected = expvar.NewInt("condition_buffer_rejected")
+)
+
+func init() {
+	expvar.Publish("condition_buffer", expvar.Func(func() interface{} {
+		entries, bytes := omIsuConditionList.Depth()
+		shards := make([]map[string]int, 0, len(omIsuConditionList.Shards))
+		for _, shard := range omIsuConditionList.Shards {
+			shard.M.Lock()
+			shards = append(shards, map[string]int{"entries": len(shard.V), "bytes": shard.Bytes})
+			shard.M.Unlock()
+		}
+		return map[string]interface{}{
+			"entries":     entries,
+			"bytes":       bytes,
+			"max_entries": omIsuConditionList.MaxEntries,
+			"max_bytes":   omIsuConditionList.MaxBytes,
+			"shards":      shards,
+		}
+	}))
+}
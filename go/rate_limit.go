@@ -0,0 +1,207 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+)
+
+// コンディション1件を1トークンとして数えるトークンバケットの設定
+// Rateが0なら無制限
+type rateLimit struct {
+	Rate  float64 `json:"rate"`  // 1秒あたりに補充されるトークン数
+	Burst int     `json:"burst"` // バケットの容量
+}
+
+// CONDITION_RATE_LIMIT_FILE で渡す設定
+// ISU毎の制限は isus > characters > default の順に優先する
+type conditionRateLimitConfig struct {
+	Default    rateLimit            `json:"default"`
+	Global     rateLimit            `json:"global"`
+	Characters map[string]rateLimit `json:"characters"`
+	Isus       map[string]rateLimit `json:"isus"`
+}
+
+// Burstを省略した場合は1秒分にする
+func (r rateLimit) normalized() rateLimit {
+	if r.Rate > 0 && r.Burst <= 0 {
+		r.Burst = int(math.Ceil(r.Rate))
+	}
+	return r
+}
+
+type tokenBucket struct {
+	Limit  rateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit rateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{Limit: limit, tokens: float64(limit.Burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens = math.Min(float64(b.Limit.Burst), b.tokens+elapsed*b.Limit.Rate)
+}
+
+// n個のトークンが溜まるまでの時間。バケットより大きい要求はバケットが満杯になるのを待たせる
+// 前の要求で借りた分(tokensが負)を返し終わるまでは満杯にならない
+func (b *tokenBucket) wait(n int) time.Duration {
+	need := math.Min(float64(n), float64(b.Limit.Burst))
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / b.Limit.Rate * float64(time.Second))
+}
+
+// バケットより大きい要求は足りない分を借りて負にし、補充で返させる
+// こうしないと満杯になる度に何件でも通ってしまい、1件あたりの制限にならない
+func (b *tokenBucket) take(n int) {
+	b.tokens -= float64(n)
+}
+
+// ヘッダに載せる残り。借りている間は0
+func (b *tokenBucket) remaining() int {
+	return int(math.Max(0, b.tokens))
+}
+
+type conditionRateLimiterT struct {
+	M      sync.Mutex
+	Config conditionRateLimitConfig
+	global *tokenBucket
+	V      map[string]*tokenBucket
+}
+
+var conditionRateLimiter = conditionRateLimiterT{V: map[string]*tokenBucket{}}
+
+var conditionRateLimited = expvar.NewMap("condition_rate_limited")
+
+// 判定結果。ヘッダに載せる
+type rateLimitResult struct {
+	Allowed    bool
+	Scope      string // 制限にかかった方。isu or global
+	Limit      rateLimit
+	Remaining  int
+	RetryAfter time.Duration
+}
+
+func loadConditionRateLimitConfig() error {
+	config := conditionRateLimitConfig{
+		Default: rateLimit{
+			Rate:  float64(getEnvInt("CONDITION_RATE_LIMIT", 0)),
+			Burst: getEnvInt("CONDITION_RATE_BURST", 0),
+		},
+		Global: rateLimit{
+			Rate:  float64(getEnvInt("CONDITION_GLOBAL_RATE_LIMIT", 0)),
+			Burst: getEnvInt("CONDITION_GLOBAL_RATE_BURST", 0),
+		},
+	}
+	if path := getEnv("CONDITION_RATE_LIMIT_FILE", ""); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &config); err != nil {
+			return fmt.Errorf("invalid %s: %v", path, err)
+		}
+	}
+	conditionRateLimiter.SetConfig(config)
+	return nil
+}
+
+func (l *conditionRateLimiterT) SetConfig(config conditionRateLimitConfig) {
+	l.M.Lock()
+	defer l.M.Unlock()
+	l.Config = config
+	l.global = nil
+	l.V = map[string]*tokenBucket{}
+}
+
+func (l *conditionRateLimiterT) limitOf(isu *Isu) rateLimit {
+	if limit, ok := l.Config.Isus[isu.JIAIsuUUID]; ok {
+		return limit.normalized()
+	}
+	if limit, ok := l.Config.Characters[isu.Character]; ok {
+		return limit.normalized()
+	}
+	return l.Config.Default.normalized()
+}
+
+// ISUとサーバー全体の両方に余裕がある場合だけn件分のトークンを消費する
+func (l *conditionRateLimiterT) Allow(isu *Isu, n int) rateLimitResult {
+	now := time.Now()
+	l.M.Lock()
+	defer l.M.Unlock()
+
+	var isuBucket, globalBucket *tokenBucket
+	if limit := l.limitOf(isu); limit.Rate > 0 {
+		isuBucket = l.V[isu.JIAIsuUUID]
+		if isuBucket == nil || isuBucket.Limit != limit {
+			isuBucket = newTokenBucket(limit, now)
+			l.V[isu.JIAIsuUUID] = isuBucket
+		}
+		isuBucket.refill(now)
+	}
+	if l.Config.Global.Rate > 0 {
+		if l.global == nil {
+			l.global = newTokenBucket(l.Config.Global.normalized(), now)
+		}
+		globalBucket = l.global
+		globalBucket.refill(now)
+	}
+
+	res := rateLimitResult{Allowed: true}
+	if isuBucket != nil {
+		if wait := isuBucket.wait(n); wait > 0 {
+			res = rateLimitResult{Scope: "isu", Limit: isuBucket.Limit, Remaining: isuBucket.remaining(), RetryAfter: wait}
+		}
+	}
+	if res.Allowed && globalBucket != nil {
+		if wait := globalBucket.wait(n); wait > 0 {
+			res = rateLimitResult{Scope: "global", Limit: globalBucket.Limit, Remaining: globalBucket.remaining(), RetryAfter: wait}
+		}
+	}
+	if !res.Allowed {
+		conditionRateLimited.Add(res.Scope, 1)
+		conditionRateLimited.Add(res.Scope+"_conditions", int64(n))
+		return res
+	}
+
+	if isuBucket != nil {
+		isuBucket.take(n)
+		res.Scope, res.Limit, res.Remaining = "isu", isuBucket.Limit, isuBucket.remaining()
+	}
+	if globalBucket != nil {
+		globalBucket.take(n)
+		if isuBucket == nil {
+			res.Scope, res.Limit, res.Remaining = "global", globalBucket.Limit, globalBucket.remaining()
+		}
+	}
+	return res
+}
+
+func setRateLimitHeaders(c echo.Context, res rateLimitResult) {
+	if res.Scope == "" {
+		return
+	}
+	h := c.Response().Header()
+	h.Set("X-RateLimit-Limit", strconv.FormatFloat(res.Limit.Rate, 'f', -1, 64))
+	h.Set("X-RateLimit-Burst", strconv.Itoa(res.Limit.Burst))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("X-RateLimit-Scope", res.Scope)
+	if !res.Allowed {
+		h.Set("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+)
+
+const defaultScoringModelVersion = "default"
+
+// グラフのスコアの計算方法
+// コンディション毎に、trueのフラグの重みの合計(badness)が収まる最初のlevelのscoreを付け
+// 座っているかどうかの重みで平均してmax_scoreを100とした値にする
+// isu_conditionのlevel列やtrendには影響しない
+type scoringModel struct {
+	Version        string         `json:"version"`
+	FlagWeights    map[string]int `json:"flag_weights"`
+	Levels         []scoringLevel `json:"levels"`
+	MaxScore       int            `json:"max_score"`
+	SittingWeight  int            `json:"sitting_weight"`
+	StandingWeight int            `json:"standing_weight"`
+}
+
+type scoringLevel struct {
+	Name       string `json:"name"`
+	MaxBadness *int   `json:"max_badness,omitempty"` // 省略すると上限なし。最後のlevelだけ省略できる
+	Score      int    `json:"score"`
+}
+
+// これまでの固定の計算と同じ。isu_condition_hourlyのraw_score_sumもこれで集計している
+func newDefaultScoringModel() *scoringModel {
+	infoMax, warningMax := 0, 2
+	return &scoringModel{
+		Version:     defaultScoringModelVersion,
+		FlagWeights: map[string]int{"is_dirty": 1, "is_overweight": 1, "is_broken": 1},
+		Levels: []scoringLevel{
+			{Name: conditionLevelInfo, MaxBadness: &infoMax, Score: scoreConditionLevelInfo},
+			{Name: conditionLevelWarning, MaxBadness: &warningMax, Score: scoreConditionLevelWarning},
+			{Name: conditionLevelCritical, Score: scoreConditionLevelCritical},
+		},
+		MaxScore:       scoreConditionLevelInfo,
+		SittingWeight:  1,
+		StandingWeight: 1,
+	}
+}
+
+func (m *scoringModel) validate() error {
+	if m.Version == "" {
+		return fmt.Errorf("missing: version")
+	}
+	for name, weight := range m.FlagWeights {
+		if name != "is_dirty" && name != "is_overweight" && name != "is_broken" {
+			return fmt.Errorf("unknown flag: %s", name)
+		}
+		if weight < 0 {
+			return fmt.Errorf("flag_weights.%s must not be negative", name)
+		}
+	}
+	if m.MaxScore <= 0 {
+		return fmt.Errorf("max_score must be positive")
+	}
+	if m.SittingWeight < 0 || m.StandingWeight < 0 || m.SittingWeight+m.StandingWeight == 0 {
+		return fmt.Errorf("sitting_weight and standing_weight must not be negative and must not both be 0")
+	}
+	if len(m.Levels) == 0 {
+		return fmt.Errorf("missing: levels")
+	}
+	for i, level := range m.Levels {
+		if level.Score < 0 || level.Score > m.MaxScore {
+			return fmt.Errorf("levels[%d].score must be between 0 and max_score", i)
+		}
+		last := i == len(m.Levels)-1
+		if last != (level.MaxBadness == nil) {
+			return fmt.Errorf("only the last level must omit max_badness")
+		}
+		if i > 0 && !last && *level.MaxBadness <= *m.Levels[i-1].MaxBadness {
+			return fmt.Errorf("levels[%d].max_badness must be greater than the previous one", i)
+		}
+	}
+	return nil
+}
+
+// isu_condition_hourlyの集計からスコアを計算できるのは、デフォルトと同じ計算をする場合だけ
+func (m *scoringModel) rollupCompatible() bool {
+	d := newDefaultScoringModel()
+	d.Version = m.Version
+	return reflect.DeepEqual(m, d)
+}
+
+// condition文字列のtrueのフラグを数え、当てはまるlevelのindexを返す
+func (m *scoringModel) level(condition string, counts map[string]int) int {
+	badness := 0
+	for _, condStr := range strings.Split(condition, ",") {
+		keyValue := strings.Split(condStr, "=")
+		if keyValue[1] == "true" {
+			counts[keyValue[0]]++
+			badness += m.FlagWeights[keyValue[0]]
+		}
+	}
+	for i, level := range m.Levels {
+		if level.MaxBadness == nil || badness <= *level.MaxBadness {
+			return i
+		}
+	}
+	return len(m.Levels) - 1
+}
+
+func (m *scoringModel) weight(isSitting bool) int {
+	if isSitting {
+		return m.SittingWeight
+	}
+	return m.StandingWeight
+}
+
+type scoringModelHolderT struct {
+	M    sync.RWMutex
+	V    *scoringModel
+	File string
+}
+
+var scoringModelHolder = scoringModelHolderT{V: newDefaultScoringModel()}
+
+func init() {
+	expvar.Publish("scoring_model", expvar.Func(func() interface{} {
+		return currentScoringModel().Version
+	}))
+}
+
+// 1回のグラフの計算では最初に取ったモデルを使い続ける
+func currentScoringModel() *scoringModel {
+	scoringModelHolder.M.RLock()
+	defer scoringModelHolder.M.RUnlock()
+	return scoringModelHolder.V
+}
+
+// SCORING_MODEL_FILEを読み直す。空ならデフォルトに戻す
+// 読めないか不正な場合は今のモデルを使い続ける
+func (h *scoringModelHolderT) Reload() (*scoringModel, error) {
+	m := newDefaultScoringModel()
+	if h.File != "" {
+		b, err := ioutil.ReadFile(h.File)
+		if err != nil {
+			return nil, err
+		}
+		// 書かなかった項目はデフォルトのまま
+		m.Version, m.Levels = "", nil
+		if err := json.Unmarshal(b, m); err != nil {
+			return nil, err
+		}
+		if m.Levels == nil {
+			m.Levels = newDefaultScoringModel().Levels
+		}
+		if err := m.validate(); err != nil {
+			return nil, err
+		}
+	}
+	h.M.Lock()
+	h.V = m
+	h.M.Unlock()
+	return m, nil
+}
+
+func loadScoringModelConfig() error {
+	scoringModelHolder.File = getEnv("SCORING_MODEL_FILE", "")
+	_, err := scoringModelHolder.Reload()
+	return err
+}
+
+// GET /admin/scoring_model
+// 使っているスコアの計算方法を確認
+func getScoringModel(c echo.Context) error {
+	return c.JSON(http.StatusOK, currentScoringModel())
+}
+
+// POST /admin/scoring_model/reload
+// SCORING_MODEL_FILEを読み直す
+func postScoringModelReload(c echo.Context) error {
+	m, err := scoringModelHolder.Reload()
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	c.Logger().Infof("scoring model reloaded: %s", m.Version)
+	return c.JSON(http.StatusOK, m)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const defaultTimezone = "Asia/Tokyo"
+
+var (
+	// tzもユーザーの設定も無い場合に使うタイムゾーン
+	defaultLocation *time.Location
+
+	errBadTimezone = errors.New("bad timezone")
+)
+
+func loadTimezoneConfig() error {
+	loc, err := loadTimezone(getEnv("DEFAULT_TIMEZONE", defaultTimezone))
+	if err != nil {
+		return err
+	}
+	defaultLocation = loc
+	return nil
+}
+
+// ユーザー毎のタイムゾーン。設定していないユーザーは空文字
+type omUserTimezoneT struct {
+	M sync.RWMutex
+	V map[string]string
+}
+
+var omUserTimezone = omUserTimezoneT{V: map[string]string{}}
+
+func (o *omUserTimezoneT) Get(jiaUserID string) (string, error) {
+	o.M.RLock()
+	v, ok := o.V[jiaUserID]
+	o.M.RUnlock()
+	if ok {
+		return v, nil
+	}
+
+	var timezone sql.NullString
+	err := db.Get(&timezone, "SELECT `timezone` FROM `user` WHERE `jia_user_id` = ?", jiaUserID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	o.Set(jiaUserID, timezone.String)
+	return timezone.String, nil
+}
+
+func (o *omUserTimezoneT) Set(jiaUserID, timezone string) {
+	o.M.Lock()
+	o.V[jiaUserID] = timezone
+	o.M.Unlock()
+}
+
+func (o *omUserTimezoneT) Reset() {
+	o.M.Lock()
+	o.V = map[string]string{}
+	o.M.Unlock()
+}
+
+// 読み込んだタイムゾーン。名前の数は限られているので、読み込めたものだけを持ち続ける
+type omTimezoneT struct {
+	M sync.RWMutex
+	V map[string]*time.Location
+}
+
+var omTimezone = omTimezoneT{V: map[string]*time.Location{}}
+
+// IANAのタイムゾーン名を読み込む
+// "Local"はサーバーのタイムゾーンになってしまうので受け付けない
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "Local" {
+		return nil, errBadTimezone
+	}
+	omTimezone.M.RLock()
+	loc, ok := omTimezone.V[name]
+	omTimezone.M.RUnlock()
+	if ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, errBadTimezone
+	}
+	omTimezone.M.Lock()
+	omTimezone.V[name] = loc
+	omTimezone.M.Unlock()
+	return loc, nil
+}
+
+// リクエストで使うタイムゾーン。tzクエリパラメータ > ユーザーの設定 > DEFAULT_TIMEZONE の順
+func requestLocation(c echo.Context, jiaUserID string) (*time.Location, error) {
+	timezone := c.QueryParam("tz")
+	if timezone == "" {
+		var err error
+		timezone, err = omUserTimezone.Get(jiaUserID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if timezone == "" {
+		return defaultLocation, nil
+	}
+	return loadTimezone(timezone)
+}
+
+type PostUserTimezoneRequest struct {
+	Timezone string `json:"timezone"`
+}
+
+// POST /api/user/me/timezone
+// グラフの日や区切りに使うタイムゾーンを設定する。空文字で設定を消す
+func postUserTimezone(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	req := PostUserTimezoneRequest{}
+	if err := c.Bind(&req); err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	if req.Timezone != "" {
+		if _, err := loadTimezone(req.Timezone); err != nil {
+			return c.String(http.StatusBadRequest, "bad format: timezone")
+		}
+	}
+
+	timezone := sql.NullString{String: req.Timezone, Valid: req.Timezone != ""}
+	if _, err := db.Exec("UPDATE `user` SET `timezone` = ? WHERE `jia_user_id` = ?", timezone, jiaUserID); err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	omUserTimezone.Set(jiaUserID, req.Timezone)
+
+	return c.JSON(http.StatusOK, req)
+}
@@ -46,3 +46,64 @@ CREATE TABLE `latest_isu_condition` (
     `message` VARCHAR(255) NOT NULL,
     `level` VARCHAR(255) NOT NULL
 ) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+DROP TABLE IF EXISTS `isu_condition_dead_letter`;
+CREATE TABLE `isu_condition_dead_letter` (
+    `id` bigint AUTO_INCREMENT PRIMARY KEY,
+    `jia_isu_uuid` VARCHAR(255) NOT NULL,
+    `timestamp` DATETIME NOT NULL,
+    `is_sitting` TINYINT(1) NOT NULL,
+    `condition` TEXT NOT NULL,
+    `message` TEXT NOT NULL,
+    `level` VARCHAR(255) NOT NULL,
+    `error` TEXT NOT NULL,
+    `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+    INDEX `idx_jia_isu_uuid` (`jia_isu_uuid`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+DROP TABLE IF EXISTS `isu_device_credential`;
+CREATE TABLE `isu_device_credential` (
+    `jia_isu_uuid` VARCHAR(36) PRIMARY KEY,
+    `secret` VARCHAR(64) NOT NULL,
+    `previous_secret` VARCHAR(64),
+    `previous_expires_at` DATETIME(6),
+    `rotated_at` DATETIME(6) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+DROP TABLE IF EXISTS `isu_condition_hourly`;
+CREATE TABLE `isu_condition_hourly` (
+    `jia_isu_uuid` CHAR(36) NOT NULL,
+    `hour` DATETIME NOT NULL,
+    `condition_count` INT NOT NULL,
+    `sitting_count` INT NOT NULL,
+    `is_dirty_count` INT NOT NULL,
+    `is_overweight_count` INT NOT NULL,
+    `is_broken_count` INT NOT NULL,
+    `raw_score_sum` INT NOT NULL,
+    PRIMARY KEY(`jia_isu_uuid`, `hour`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+DROP TABLE IF EXISTS `isu_group`;
+CREATE TABLE `isu_group` (
+    `id` bigint AUTO_INCREMENT PRIMARY KEY,
+    `name` VARCHAR(255) NOT NULL,
+    `jia_user_id` VARCHAR(255) NOT NULL,
+    `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+    INDEX `idx_jia_user_id` (`jia_user_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+DROP TABLE IF EXISTS `isu_group_member`;
+CREATE TABLE `isu_group_member` (
+    `group_id` bigint NOT NULL,
+    `jia_user_id` VARCHAR(255) NOT NULL,
+    PRIMARY KEY(`group_id`, `jia_user_id`),
+    INDEX `idx_jia_user_id` (`jia_user_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+DROP TABLE IF EXISTS `isu_group_isu`;
+CREATE TABLE `isu_group_isu` (
+    `group_id` bigint NOT NULL,
+    `jia_isu_uuid` CHAR(36) NOT NULL,
+    PRIMARY KEY(`group_id`, `jia_isu_uuid`),
+    INDEX `idx_jia_isu_uuid` (`jia_isu_uuid`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
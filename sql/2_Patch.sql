@@ -6,3 +6,11 @@ UPDATE `isu_condition` SET `level` = 'info' WHERE CHAR_LENGTH(`condition`) = 50;
 
 
 ALTER TABLE `isu` MODIFY COLUMN `image` longblob INVISIBLE;
+
+-- 日時はUTCで持つ。初期データは日本時間なのでずらす
+-- PRIMARY KEYに含まれるので、ぶつからないように古い順に更新する
+UPDATE `isu_condition` SET `timestamp` = CONVERT_TZ(`timestamp`, '+09:00', '+00:00') ORDER BY `jia_isu_uuid`, `timestamp` ASC;
+UPDATE `isu` SET `created_at` = CONVERT_TZ(`created_at`, '+09:00', '+00:00'), `updated_at` = CONVERT_TZ(`updated_at`, '+09:00', '+00:00');
+UPDATE `user` SET `created_at` = CONVERT_TZ(`created_at`, '+09:00', '+00:00');
+
+ALTER TABLE `user` ADD COLUMN `timezone` VARCHAR(64) DEFAULT NULL;